@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/filecoin-project/go-address"
+	"github.com/gin-gonic/gin"
+	"github.com/glifio/go-logger"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrAdminUnauthorized = errors.New("Not allowed")
+	ErrUnknownMode       = errors.New("unknown mode, expected faucet or verifier")
+	ErrUnknownBudget     = errors.New("unknown budget, expected COUNT, BYTES or NANOFIL")
+)
+
+func startAdmin(router *gin.Engine) {
+	admin := router.Group("/admin", requireAdmin)
+
+	admin.GET("/counter", serveAdminGetCounter)
+	admin.DELETE("/counter", serveAdminResetCounter)
+	admin.POST("/counter/adjust", serveAdminAdjustCounter)
+
+	admin.GET("/users", serveAdminFindUsers)
+	admin.GET("/users/:id", serveAdminGetUser)
+	admin.POST("/users/:id/unlock/:mode", serveAdminUnlockUser)
+	admin.POST("/users/:id/fail/:mode", serveAdminFailGrant)
+	admin.POST("/users/:id/redrive/:mode", serveAdminRedriveGrant)
+	admin.GET("/locked/:mode", serveAdminListLocked)
+
+	admin.GET("/blocklist", serveAdminListBlocklist)
+	admin.PUT("/blocklist/:addr", serveAdminBlockAddress)
+	admin.DELETE("/blocklist/:addr", serveAdminUnblockAddress)
+
+	admin.GET("/signer", serveAdminSignerStatus)
+	admin.GET("/senders", serveAdminSenders)
+	admin.POST("/signer/reload", serveAdminReloadSigner)
+
+	admin.GET("/audit", serveAdminQueryAudit)
+
+	admin.GET("/pause", serveAdminGetPaused)
+	admin.POST("/pause/:mode", serveAdminPause)
+	admin.POST("/resume/:mode", serveAdminResume)
+}
+
+// requireAdmin accepts either a static token from ADMIN_TOKENS or a JWT signed with JWT_SECRET carrying role=admin
+func requireAdmin(c *gin.Context) {
+	authHeader := c.GetHeader("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": ErrAdminUnauthorized.Error()})
+		return
+	}
+	token := strings.TrimSpace(authHeader[len("Bearer "):])
+
+	name, ok := adminFromStaticToken(token)
+	if !ok {
+		name, ok = adminFromJWT(token)
+	}
+	if !ok {
+		logger.Warningf("ADMIN AUTH FAILED: %v %v from %v", c.Request.Method, c.FullPath(), c.ClientIP())
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": ErrAdminUnauthorized.Error()})
+		return
+	}
+
+	c.Set("admin", name)
+	c.Next()
+}
+
+// adminFromStaticToken matches against ADMIN_TOKENS, a comma separated list of name:token pairs
+func adminFromStaticToken(token string) (string, bool) {
+	if token == "" || env.AdminTokens == "" {
+		return "", false
+	}
+	for i, entry := range strings.Split(env.AdminTokens, ",") {
+		name := fmt.Sprintf("token-%d", i)
+		secret := strings.TrimSpace(entry)
+		if idx := strings.Index(secret, ":"); idx >= 0 {
+			name, secret = secret[:idx], secret[idx+1:]
+		}
+		if secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(token)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// adminFromJWT accepts a JWT with an admin role and an expiry, signed with ADMIN_JWT_SECRET. Without a secret
+// of its own no JWT is accepted, so a leaked JWT_SECRET can't mint admin tokens.
+func adminFromJWT(tokenString string) (string, bool) {
+	secret := env.AdminJWTSecret
+	if secret == "" || secret == env.JWTSecret {
+		return "", false
+	}
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(secret), nil
+	})
+	if err != nil {
+		return "", false
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return "", false
+	}
+	// an admin token without an expiry would be valid forever
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return "", false
+	}
+	if role, _ := claims["role"].(string); role != "admin" {
+		return "", false
+	}
+	name, _ := claims["sub"].(string)
+	if name == "" {
+		name, _ = claims["userID"].(string)
+	}
+	return "jwt:" + name, true
+}
+
+// auditAdminAction records who did what through the admin API
+func auditAdminAction(c *gin.Context, action string, details gin.H) {
+	recordAdminAction(c.GetString("admin"), c.ClientIP(), action, details)
+}
+
+func recordAdminAction(admin, clientIP, action string, details gin.H) {
+	recordAudit(context.Background(), AuditEvent{
+		Type:     AuditAdmin,
+		Admin:    admin,
+		Action:   action,
+		ClientIP: clientIP,
+		Details:  details,
+	})
+}
+
+func parseMode(s string) (Mode, UserLock, error) {
+	switch strings.ToUpper(s) {
+	case string(FaucetMode):
+		return FaucetMode, UserLock_Faucet, nil
+	case string(VerifierMode):
+		return VerifierMode, UserLock_Verifier, nil
+	}
+	return "", "", ErrUnknownMode
+}
+
+func parseModeParam(c *gin.Context) (Mode, UserLock, bool) {
+	mode, lock, err := parseMode(c.Param("mode"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return "", "", false
+	}
+	return mode, lock, true
+}
+
+func serveAdminGetCounter(c *gin.Context) {
+	type Budget struct {
+		Used  int64 `json:"used"`
+		Limit int64 `json:"limit"`
+	}
+	budgets := make(map[string]Budget)
+	for _, b := range allBudgets() {
+		if !b.enabled() {
+			continue
+		}
+		used, err := b.used(c)
+		if err != nil {
+			logger.Errorf("REDIS GET COUNT FAILED: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		budgets[b.name] = Budget{used, b.limit}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"window":  env.AllocationsWindow,
+		"budgets": budgets,
+	})
+}
+
+func serveAdminResetCounter(c *gin.Context) {
+	if err := resetCounter(c); err != nil {
+		logger.Errorf("REDIS RESET COUNT FAILED: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	auditAdminAction(c, "counter.reset", nil)
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+func serveAdminAdjustCounter(c *gin.Context) {
+	type Request struct {
+		Budget string `json:"budget" binding:"required"`
+		Delta  int64  `json:"delta" binding:"required"`
+	}
+	var body Request
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	b, ok := budgetByName(strings.ToUpper(body.Budget))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": ErrUnknownBudget.Error()})
+		return
+	}
+	if err := b.adjust(c, body.Delta); err != nil {
+		logger.Errorf("REDIS ADJUST COUNT FAILED: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	auditAdminAction(c, "counter.adjust", gin.H{"budget": b.name, "delta": body.Delta})
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+func serveAdminGetUser(c *gin.Context) {
+	user, err := getUserByID(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	auditAdminAction(c, "user.get", gin.H{"userID": user.ID})
+	c.JSON(http.StatusOK, user)
+}
+
+// serveAdminFindUsers looks users up by ?address= (verified or faucet) or by ?github= username
+func serveAdminFindUsers(c *gin.Context) {
+	var users []User
+	var err error
+	if addr := c.Query("address"); addr != "" {
+		users, err = getUsersByAddress(c.Request.Context(), addr)
+	} else if username := c.Query("github"); username != "" {
+		users, err = getUsersByProviderUsername(c.Request.Context(), "github", username)
+	} else {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expected an address or github query parameter"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	auditAdminAction(c, "user.find", gin.H{"address": c.Query("address"), "github": c.Query("github")})
+	c.JSON(http.StatusOK, users)
+}
+
+func serveAdminUnlockUser(c *gin.Context) {
+	_, lock, ok := parseModeParam(c)
+	if !ok {
+		return
+	}
+	userID := c.Param("id")
+	if err := unlockUser(c.Request.Context(), userID, lock); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	auditAdminAction(c, "user.unlock", gin.H{"userID": userID, "lock": lock})
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+func serveAdminListLocked(c *gin.Context) {
+	_, lock, ok := parseModeParam(c)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	grants, err := listLockedGrants(ctx, lock)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, grants)
+}
+
+func serveAdminFailGrant(c *gin.Context) {
+	_, lock, ok := parseModeParam(c)
+	if !ok {
+		return
+	}
+	userID := c.Param("id")
+	if err := failLockedGrant(c, userID, lock); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	auditAdminAction(c, "grant.fail", gin.H{"userID": userID, "lock": lock})
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// serveAdminRedriveGrant resends a locked user's grant, ?force=true also resends messages that weren't found on chain
+func serveAdminRedriveGrant(c *gin.Context) {
+	_, lock, ok := parseModeParam(c)
+	if !ok {
+		return
+	}
+	userID := c.Param("id")
+	force := c.Query("force") == "true"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	newCid, err := redriveLockedGrant(ctx, userID, lock, force)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	auditAdminAction(c, "grant.redrive", gin.H{"userID": userID, "lock": lock, "force": force, "cid": newCid.String()})
+	c.JSON(http.StatusOK, gin.H{"cid": newCid.String()})
+}
+
+func serveAdminListBlocklist(c *gin.Context) {
+	addrs, err := listBlockedAddresses(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, addrs)
+}
+
+func serveAdminBlockAddress(c *gin.Context) {
+	addr, err := address.NewFromString(c.Param("addr"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := blockAddress(c, addr); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	auditAdminAction(c, "blocklist.add", gin.H{"address": addr.String()})
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+func serveAdminUnblockAddress(c *gin.Context) {
+	addr, err := address.NewFromString(c.Param("addr"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := unblockAddress(c, addr); err != nil {
+		code := http.StatusInternalServerError
+		if err == ErrBlockedByEnv {
+			code = http.StatusConflict
+		}
+		c.JSON(code, gin.H{"error": err.Error()})
+		return
+	}
+	auditAdminAction(c, "blocklist.remove", gin.H{"address": addr.String()})
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+func serveAdminGetPaused(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"faucet":   isModePaused(FaucetMode),
+		"verifier": isModePaused(VerifierMode),
+	})
+}
+
+func serveAdminPause(c *gin.Context) {
+	mode, _, ok := parseModeParam(c)
+	if !ok {
+		return
+	}
+	if err := setModePaused(c, mode, true); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	auditAdminAction(c, "mode.pause", gin.H{"mode": mode})
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+func serveAdminResume(c *gin.Context) {
+	mode, _, ok := parseModeParam(c)
+	if !ok {
+		return
+	}
+	if err := setModePaused(c, mode, false); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	auditAdminAction(c, "mode.resume", gin.H{"mode": mode})
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+func serveAdminSignerStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, signers.status())
+}
+
+func serveAdminReloadSigner(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := signers.load(ctx); err != nil {
+		logger.Errorf("SIGNER RELOAD FAILED: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	auditAdminAction(c, "signer.reload", gin.H{"faucet": faucetSenders.addrs(), "verifier": verifierSenders.addrs()})
+	c.JSON(http.StatusOK, signers.status())
+}
+
+func serveAdminSenders(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	resp := gin.H{}
+	if env.Mode != VerifierMode {
+		faucetSenders.refresh(ctx)
+		resp["faucet"] = faucetSenders.status()
+	}
+	if env.Mode != FaucetMode {
+		verifierSenders.refresh(ctx)
+		resp["verifier"] = verifierSenders.status()
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func serveAdminQueryAudit(c *gin.Context) {
+	q, err := parseAuditQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	events, err := queryAudit(c.Request.Context(), q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, events)
+}
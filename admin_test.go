@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestAdminJWTNeedsItsOwnSecret(t *testing.T) {
+	secret := env.AdminJWTSecret
+	defer func() { env.AdminJWTSecret = secret }()
+
+	sign := func(key string) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"role": "admin",
+			"sub":  "ops",
+			"exp":  time.Now().Add(time.Hour).Unix(),
+		}).SignedString([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	for _, adminSecret := range []string{"", env.JWTSecret} {
+		env.AdminJWTSecret = adminSecret
+		if _, ok := adminFromJWT(sign(env.JWTSecret)); ok {
+			t.Fatalf("expected a JWT signed with JWT_SECRET to be refused with ADMIN_JWT_SECRET %q", adminSecret)
+		}
+	}
+
+	env.AdminJWTSecret = "admin-secret"
+	if name, ok := adminFromJWT(sign("admin-secret")); !ok || name != "jwt:ops" {
+		t.Fatalf("expected the admin JWT to be accepted, got %q %v", name, ok)
+	}
+	if _, ok := adminFromJWT(sign(env.JWTSecret)); ok {
+		t.Fatal("expected a JWT signed with JWT_SECRET to be refused")
+	}
+}
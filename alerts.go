@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/getsentry/sentry-go"
+	"github.com/glifio/go-logger"
+	"github.com/pkg/errors"
+	"gopkg.in/robfig/cron.v2"
+)
+
+// alert is a threshold check that is currently failing
+type alert struct {
+	Key     string
+	Mode    Mode
+	Address string
+	Text    string
+}
+
+// alertState remembers which alerts are firing, so they are sent once and then every AlertRepeatInterval
+type alertState struct {
+	lk     sync.Mutex
+	firing map[string]time.Time
+}
+
+var alerts = &alertState{firing: make(map[string]time.Time)}
+
+var alertClient = &http.Client{Timeout: 10 * time.Second}
+
+func startAlerts(c *cron.Cron) {
+	if env.AlertWebhookURLs == "" && !logger.IsSentryEnabled() {
+		return
+	}
+	logger.Infof("Alerts schedule: %v", env.AlertSchedule)
+	if _, err := c.AddFunc(env.AlertSchedule, checkAlerts); err != nil {
+		logger.Errorf("ERROR SCHEDULING ALERTS: %v", err)
+	}
+}
+
+// verifierLowDataCap defaults to the 50 grants we used to warn at
+func verifierLowDataCap() big.Int {
+	if env.VerifierLowDataCapBytes.GreaterThan(big.Zero()) {
+		return env.VerifierLowDataCapBytes
+	}
+	return big.Mul(env.MaxAllowanceBytes, big.NewInt(50))
+}
+
+// lowBalanceAlerts checks every sender of the running modes against its threshold, a sender that can't be
+// checked gets a balance check alert of its own
+func lowBalanceAlerts(ctx context.Context) []alert {
+	var firing []alert
+
+	if env.Mode != VerifierMode && env.FaucetLowBalanceFIL.Int.Sign() > 0 {
+		threshold := big.Int(env.FaucetLowBalanceFIL)
+		for _, addr := range faucetSenders.addrs() {
+			bal, err := faucetSenders.fetchAvailable(ctx, addr)
+			if err != nil {
+				logger.Errorf("ERROR CHECKING FAUCET BALANCE OF %v: %v", addr, err)
+				firing = append(firing, balanceCheckFailed(FaucetMode, addr, err))
+				continue
+			}
+			if bal.LessThan(threshold) {
+				firing = append(firing, alert{
+					Key:     "FAUCET_BALANCE:" + addr.String(),
+					Mode:    FaucetMode,
+					Address: addr.String(),
+					Text:    fmt.Sprintf("Faucet %v balance is %v, below %v", addr, types.FIL(bal), env.FaucetLowBalanceFIL),
+				})
+			}
+		}
+	}
+
+	if env.Mode != FaucetMode {
+		threshold := verifierLowDataCap()
+		addrs := verifierSenders.addrs()
+		if verifierSenders.sharedAvailable() {
+			addrs = addrs[:1]
+		}
+		for _, addr := range addrs {
+			notary := addr
+			if verifierSenders.sharedAvailable() {
+				notary = notaryAddr()
+			}
+			dcap, err := verifierSenders.fetchAvailable(ctx, addr)
+			if err != nil {
+				logger.Errorf("ERROR CHECKING VERIFIER DATACAP OF %v: %v", notary, err)
+				firing = append(firing, balanceCheckFailed(VerifierMode, notary, err))
+				continue
+			}
+			if dcap.LessThan(threshold) {
+				firing = append(firing, alert{
+					Key:     "VERIFIER_DATACAP:" + notary.String(),
+					Mode:    VerifierMode,
+					Address: notary.String(),
+					Text:    fmt.Sprintf("Verifier %v datacap is %v bytes, below %v bytes", notary, dcap, threshold),
+				})
+			}
+		}
+	}
+	return firing
+}
+
+// balanceCheckFailed is the alert for a sender whose balance or datacap the node couldn't tell us
+func balanceCheckFailed(mode Mode, addr address.Address, err error) alert {
+	return alert{
+		Key:     "BALANCE_CHECK_FAILED:" + addr.String(),
+		Mode:    mode,
+		Address: addr.String(),
+		Text:    fmt.Sprintf("Checking the %s balance of %v failed: %v", strings.ToLower(string(mode)), addr, err),
+	}
+}
+
+func checkAlerts() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	firing := lowBalanceAlerts(ctx)
+	toSend, resolved := alerts.update(firing, time.Now())
+	for _, a := range toSend {
+		sendAlert(ctx, a, false)
+	}
+	for _, a := range resolved {
+		sendAlert(ctx, a, true)
+	}
+}
+
+// update returns the alerts that are new or due a repeat, and the ones that stopped firing
+func (s *alertState) update(firing []alert, now time.Time) ([]alert, []alert) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	var toSend []alert
+	stillFiring := make(map[string]bool, len(firing))
+	for _, a := range firing {
+		stillFiring[a.Key] = true
+		if lastSent, ok := s.firing[a.Key]; ok && now.Sub(lastSent) < env.AlertRepeatInterval {
+			continue
+		}
+		s.firing[a.Key] = now
+		toSend = append(toSend, a)
+	}
+
+	var resolved []alert
+	for key := range s.firing {
+		if !stillFiring[key] {
+			delete(s.firing, key)
+			resolved = append(resolved, alert{Key: key, Text: "Resolved: " + key})
+		}
+	}
+	return toSend, resolved
+}
+
+// sendAlert posts to every webhook and captures a Sentry event. The payload carries both `text` (Slack)
+// and `content` (Discord).
+func sendAlert(ctx context.Context, a alert, resolved bool) {
+	// logged at info so the logger's own Sentry hook doesn't report it a second time
+	logger.Infof("ALERT: %v", a.Text)
+
+	body, err := json.Marshal(map[string]string{"text": a.Text, "content": a.Text})
+	if err != nil {
+		logger.Errorf("ERROR ENCODING ALERT: %v", err)
+		return
+	}
+	for _, url := range splitList(env.AlertWebhookURLs) {
+		if err := postAlert(ctx, url, body); err != nil {
+			logger.Errorf("ERROR SENDING ALERT TO WEBHOOK: %v", err)
+		}
+	}
+
+	if logger.IsSentryEnabled() && !resolved {
+		sentry.WithScope(func(scope *sentry.Scope) {
+			scope.SetLevel(sentry.LevelWarning)
+			scope.SetTag("alert", a.Key)
+			scope.SetTag("mode", string(a.Mode))
+			scope.SetTag("address", a.Address)
+			sentry.CaptureMessage(a.Text)
+		})
+	}
+}
+
+func postAlert(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := alertClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("webhook responded %v", resp.Status)
+	}
+	return nil
+}
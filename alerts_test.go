@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// webhookSink records what the alerts post to it
+type webhookSink struct {
+	*httptest.Server
+
+	lk       sync.Mutex
+	payloads []map[string]string
+}
+
+func newWebhookSink(t *testing.T) *webhookSink {
+	sink := &webhookSink{}
+	sink.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("expected a JSON payload, got %q", r.Header.Get("Content-Type"))
+		}
+		var payload map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("decoding payload: %v", err)
+		}
+		sink.lk.Lock()
+		sink.payloads = append(sink.payloads, payload)
+		sink.lk.Unlock()
+	}))
+	t.Cleanup(sink.Close)
+	return sink
+}
+
+func (s *webhookSink) received() []map[string]string {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return append([]map[string]string(nil), s.payloads...)
+}
+
+func TestAlertWebhookPayload(t *testing.T) {
+	slack, discord := newWebhookSink(t), newWebhookSink(t)
+	urls := env.AlertWebhookURLs
+	env.AlertWebhookURLs = slack.URL + "," + discord.URL
+	defer func() { env.AlertWebhookURLs = urls }()
+
+	sendAlert(context.Background(), alert{Key: "TEST", Text: "balance is low"}, false)
+	for _, sink := range []*webhookSink{slack, discord} {
+		got := sink.received()
+		if len(got) != 1 || got[0]["text"] != "balance is low" || got[0]["content"] != "balance is low" {
+			t.Fatalf("expected text and content to carry the alert, got %v", got)
+		}
+	}
+}
+
+func TestAlertsRepeatAndResolve(t *testing.T) {
+	s := &alertState{firing: make(map[string]time.Time)}
+	a := alert{Key: "FAUCET_BALANCE:f1", Text: "low"}
+	now := time.Now()
+
+	toSend, resolved := s.update([]alert{a}, now)
+	if len(toSend) != 1 || len(resolved) != 0 {
+		t.Fatalf("expected a new alert to be sent, got %v %v", toSend, resolved)
+	}
+	toSend, _ = s.update([]alert{a}, now.Add(env.AlertRepeatInterval/2))
+	if len(toSend) != 0 {
+		t.Fatalf("expected the repeat to wait for ALERT_REPEAT_INTERVAL, got %v", toSend)
+	}
+	toSend, _ = s.update([]alert{a}, now.Add(env.AlertRepeatInterval))
+	if len(toSend) != 1 {
+		t.Fatalf("expected the alert to repeat, got %v", toSend)
+	}
+	toSend, resolved = s.update(nil, now.Add(env.AlertRepeatInterval+time.Minute))
+	if len(toSend) != 0 || len(resolved) != 1 || resolved[0].Key != a.Key {
+		t.Fatalf("expected the alert to resolve, got %v %v", toSend, resolved)
+	}
+}
+
+func TestFaucetLowBalanceAlert(t *testing.T) {
+	s := newTestServer(t)
+	sink := newWebhookSink(t)
+	urls, low := env.AlertWebhookURLs, env.FaucetLowBalanceFIL
+	env.AlertWebhookURLs = sink.URL
+	env.FaucetLowBalanceFIL = types.MustParseFIL("100fil")
+	alerts = &alertState{firing: make(map[string]time.Time)}
+	defer func() { env.AlertWebhookURLs, env.FaucetLowBalanceFIL = urls, low }()
+
+	faucet := faucetSenders.addrs()[0]
+	s.node.setBalance(faucet, big.NewInt(1))
+	checkAlerts()
+	got := sink.received()
+	if len(got) != 1 || !strings.Contains(got[0]["text"], faucet.String()) {
+		t.Fatalf("expected an alert about %v, got %v", faucet, got)
+	}
+
+	s.node.setBalance(faucet, big.Int(types.MustParseFIL("1000fil")))
+	checkAlerts()
+	got = sink.received()
+	if len(got) != 2 || !strings.HasPrefix(got[1]["text"], "Resolved: ") {
+		t.Fatalf("expected the alert to resolve, got %v", got)
+	}
+}
+
+func TestBalanceCheckFailedAlert(t *testing.T) {
+	s := newTestServer(t)
+	sink := newWebhookSink(t)
+	urls, low := env.AlertWebhookURLs, env.FaucetLowBalanceFIL
+	env.AlertWebhookURLs = sink.URL
+	env.FaucetLowBalanceFIL = types.MustParseFIL("100fil")
+	alerts = &alertState{firing: make(map[string]time.Time)}
+	defer func() { env.AlertWebhookURLs, env.FaucetLowBalanceFIL = urls, low }()
+
+	// the next sender is still checked when the balance of the first can't be
+	faucet, other := faucetSenders.addrs()[0], testClientAddr(t, "faucet-2")
+	setSenders(FaucetMode, []address.Address{faucet, other})
+	defer setSenders(FaucetMode, []address.Address{faucet})
+	s.node.failBalance(faucet, errors.New("node unavailable"))
+	s.node.setBalance(other, big.NewInt(1))
+	var keys []string
+	for _, a := range lowBalanceAlerts(context.Background()) {
+		if a.Mode == FaucetMode {
+			keys = append(keys, a.Key)
+		}
+	}
+	if len(keys) != 2 || keys[0] != "BALANCE_CHECK_FAILED:"+faucet.String() || keys[1] != "FAUCET_BALANCE:"+other.String() {
+		t.Fatalf("expected a failed check and a low balance alert, got %v", keys)
+	}
+
+	checkAlerts()
+	if got := sink.received(); len(got) != 2 || !strings.Contains(got[0]["text"], "node unavailable") {
+		t.Fatalf("expected the failed check to be posted, got %v", got)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	verifregtypes "github.com/filecoin-project/go-state-types/builtin/v9/verifreg"
+	"github.com/gin-gonic/gin"
+	"github.com/glifio/go-logger"
+	"github.com/pkg/errors"
+	"gopkg.in/robfig/cron.v2"
+)
+
+// AllocationState is where an allocation is in its life
+type AllocationState string
+
+const (
+	// AllocationPending is waiting for the provider to claim it
+	AllocationPending AllocationState = "pending"
+	// AllocationClaimed was claimed by the provider, the record carries the claim
+	AllocationClaimed AllocationState = "claimed"
+	// AllocationExpired is still in the registry but past its expiration, its datacap can be reclaimed
+	AllocationExpired AllocationState = "expired"
+	// AllocationRemoved left the registry without a claim we could find, usually an expired one removed
+	AllocationRemoved AllocationState = "removed"
+)
+
+var (
+	// ErrAllocationsNotReady is returned until the allocations are first indexed
+	ErrAllocationsNotReady = errors.New("the allocation index is not ready yet")
+	// ErrNotOurClient is returned for addresses this notary never granted datacap to
+	ErrNotOurClient = errors.New("no datacap was granted to this address by this notary")
+)
+
+// AllocationRecord is one allocation of a client, or a claim of it when the allocation was never seen
+type AllocationRecord struct {
+	ID         verifregtypes.AllocationId `json:"id,omitempty"`
+	ClaimID    verifregtypes.ClaimId      `json:"claimId,omitempty"`
+	State      AllocationState            `json:"state"`
+	Provider   string                     `json:"provider"`
+	PieceCID   string                     `json:"pieceCid"`
+	Size       abi.PaddedPieceSize        `json:"size"`
+	TermMin    abi.ChainEpoch             `json:"termMin"`
+	TermMax    abi.ChainEpoch             `json:"termMax"`
+	Expiration abi.ChainEpoch             `json:"expiration,omitempty"`
+	TermStart  abi.ChainEpoch             `json:"termStart,omitempty"`
+	Sector     abi.SectorNumber           `json:"sector,omitempty"`
+	FirstSeen  abi.ChainEpoch             `json:"firstSeen"`
+	UpdatedAt  abi.ChainEpoch             `json:"updatedAt"`
+}
+
+// clientAllocations is what the index knows about one client
+type clientAllocations struct {
+	Client    string              `json:"client"`
+	IDAddress string              `json:"idAddress,omitempty"`
+	Height    abi.ChainEpoch      `json:"height"`
+	Records   []*AllocationRecord `json:"allocations"`
+
+	clientID  abi.ActorID
+	hasID     bool
+	allocs    map[verifregtypes.AllocationId]*AllocationRecord
+	claims    map[address.Address]map[verifregtypes.ClaimId]bool
+	providers map[address.Address]bool
+	// claimOnly holds the claims whose allocation we never saw, claim IDs are only unique per provider
+	claimOnly map[claimKey]*AllocationRecord
+}
+
+type claimKey struct {
+	provider address.Address
+	id       verifregtypes.ClaimId
+}
+
+// allocationIndex follows the allocations and claims of the clients we granted datacap to. Claims are looked
+// up under each provider the client allocated to, or made deals with according to the notary report.
+type allocationIndex struct {
+	// refreshLk guards clients, which only the indexer touches
+	refreshLk sync.Mutex
+	clients   map[string]*clientAllocations
+
+	// lk guards what the endpoint reads
+	lk      sync.RWMutex
+	view    map[string]*clientAllocations
+	height  abi.ChainEpoch
+	lastErr error
+}
+
+var allocations = &allocationIndex{clients: map[string]*clientAllocations{}}
+
+// startAllocationIndexer indexes now and on ALLOCATION_INDEX_SCHEDULE
+func startAllocationIndexer(c *cron.Cron) {
+	go allocations.refresh()
+	if _, err := c.AddFunc(env.AllocationIndexSchedule, allocations.refresh); err != nil {
+		logger.Errorf("ERROR SCHEDULING ALLOCATION INDEXER: %v", err)
+	}
+}
+
+func (ix *allocationIndex) refresh() {
+	ctx, span := tracer.Start(context.Background(), "refreshAllocationIndex")
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Minute)
+	defer cancel()
+
+	err := ix.refreshAt(ctx)
+	if err != nil {
+		logger.Errorf("ERROR INDEXING ALLOCATIONS: %v", err)
+	}
+	ix.lk.Lock()
+	ix.lastErr = err
+	ix.lk.Unlock()
+}
+
+func (ix *allocationIndex) refreshAt(ctx context.Context) error {
+	if err := backfillVerifierGrants(ctx); err != nil {
+		return errors.Wrap(err, "backfilling grants")
+	}
+	grants, err := getGrants(ctx, VerifierMode, GrantConfirmed)
+	if err != nil {
+		return errors.Wrap(err, "getting grants")
+	}
+
+	lapi, closer, err := lotusGetFullNodeAPI(ctx)
+	if err != nil {
+		return err
+	}
+	defer closer()
+	head, err := lapi.ChainHead(ctx)
+	if err != nil {
+		return err
+	}
+	tsk := head.Key()
+	height := head.Height()
+
+	ix.refreshLk.Lock()
+	defer ix.refreshLk.Unlock()
+
+	for _, g := range grants {
+		if _, ok := ix.clients[g.Address]; ok {
+			continue
+		}
+		ix.clients[g.Address] = &clientAllocations{
+			Client:    g.Address,
+			allocs:    map[verifregtypes.AllocationId]*AllocationRecord{},
+			claims:    map[address.Address]map[verifregtypes.ClaimId]bool{},
+			providers: map[address.Address]bool{},
+			claimOnly: map[claimKey]*AllocationRecord{},
+		}
+	}
+	ix.addReportProviders()
+
+	byID := map[abi.ActorID]*clientAllocations{}
+	providers := map[address.Address]bool{}
+	for _, ca := range ix.clients {
+		addr, err := address.NewFromString(ca.Client)
+		if err != nil {
+			continue
+		}
+		if !ca.hasID {
+			idAddr, err := lapi.StateLookupID(ctx, addr, tsk)
+			if ignoreNotFound(err) != nil {
+				return errors.Wrapf(err, "looking up %v", addr)
+			}
+			if err != nil {
+				// the client has no actor yet, so it can't have allocated
+				continue
+			}
+			id, err := address.IDFromAddress(idAddr)
+			if err != nil {
+				return err
+			}
+			ca.IDAddress, ca.clientID, ca.hasID = idAddr.String(), abi.ActorID(id), true
+		}
+		byID[ca.clientID] = ca
+
+		current, err := lapi.StateGetAllocations(ctx, addr, tsk)
+		if ignoreNotFound(err) != nil {
+			return errors.Wrapf(err, "getting allocations of %v", addr)
+		}
+
+		for id, a := range current {
+			provider, _ := address.NewIDAddress(uint64(a.Provider))
+			ca.providers[provider] = true
+			rec, ok := ca.allocs[id]
+			if !ok {
+				rec = &AllocationRecord{
+					ID:         id,
+					Provider:   provider.String(),
+					PieceCID:   a.Data.String(),
+					Size:       a.Size,
+					TermMin:    a.TermMin,
+					TermMax:    a.TermMax,
+					Expiration: a.Expiration,
+					FirstSeen:  height,
+				}
+				ca.allocs[id] = rec
+			}
+			state := AllocationPending
+			if a.Expiration < height {
+				state = AllocationExpired
+			}
+			if rec.State != state {
+				rec.State, rec.UpdatedAt = state, height
+			}
+		}
+		// allocations that left the registry were claimed or removed, the claims below tell which
+		for id, rec := range ca.allocs {
+			if _, ok := current[id]; !ok && (rec.State == AllocationPending || rec.State == AllocationExpired) {
+				rec.State, rec.UpdatedAt = AllocationRemoved, height
+			}
+		}
+		for provider := range ca.providers {
+			providers[provider] = true
+		}
+	}
+
+	for provider := range providers {
+		claims, err := lapi.StateGetClaims(ctx, provider, tsk)
+		if ignoreNotFound(err) != nil {
+			return errors.Wrapf(err, "getting claims of %v", provider)
+		}
+		for claimID, claim := range claims {
+			if ca, ok := byID[claim.Client]; ok {
+				ca.addClaim(provider, claimID, claim, height)
+			}
+		}
+	}
+
+	// publish copies, so the endpoint never waits on a refresh
+	view := make(map[string]*clientAllocations, len(ix.clients))
+	for key, ca := range ix.clients {
+		published := &clientAllocations{Client: ca.Client, IDAddress: ca.IDAddress, Height: height}
+		for _, rec := range ca.allocs {
+			r := *rec
+			published.Records = append(published.Records, &r)
+		}
+		for _, rec := range ca.claimOnly {
+			r := *rec
+			published.Records = append(published.Records, &r)
+		}
+		sort.Slice(published.Records, func(i, j int) bool {
+			ri, rj := published.Records[i], published.Records[j]
+			if ri.FirstSeen != rj.FirstSeen {
+				return ri.FirstSeen < rj.FirstSeen
+			}
+			if ri.ID != rj.ID {
+				return ri.ID < rj.ID
+			}
+			if ri.Provider != rj.Provider {
+				return ri.Provider < rj.Provider
+			}
+			return ri.ClaimID < rj.ClaimID
+		})
+		view[key] = published
+	}
+
+	ix.lk.Lock()
+	defer ix.lk.Unlock()
+	ix.view, ix.height = view, height
+	return nil
+}
+
+// addReportProviders adds the providers of each client's verified deals, from the last notary report
+func (ix *allocationIndex) addReportProviders() {
+	notaryReportLk.RLock()
+	report := notaryReportLast
+	notaryReportLk.RUnlock()
+	if report == nil {
+		return
+	}
+	for _, cr := range report.Clients {
+		ca, ok := ix.clients[cr.Address]
+		if !ok {
+			continue
+		}
+		for _, pu := range cr.Providers {
+			if provider, err := address.NewFromString(pu.Provider); err == nil {
+				ca.providers[provider] = true
+			}
+		}
+	}
+}
+
+// addClaim matches a claim to the removed allocation it came from, or records it on its own
+func (ca *clientAllocations) addClaim(provider address.Address, claimID verifregtypes.ClaimId, claim verifregtypes.Claim, height abi.ChainEpoch) {
+	if ca.claims[provider] == nil {
+		ca.claims[provider] = map[verifregtypes.ClaimId]bool{}
+	}
+	if ca.claims[provider][claimID] {
+		return
+	}
+	ca.claims[provider][claimID] = true
+
+	var rec *AllocationRecord
+	for _, r := range ca.allocs {
+		if r.State == AllocationRemoved && r.Provider == provider.String() && r.PieceCID == claim.Data.String() && r.Size == claim.Size {
+			rec = r
+			break
+		}
+	}
+	if rec == nil {
+		// claimed before we saw the allocation, so there is no allocation ID to key it by
+		rec = &AllocationRecord{
+			Provider:  provider.String(),
+			PieceCID:  claim.Data.String(),
+			Size:      claim.Size,
+			TermMin:   claim.TermMin,
+			TermMax:   claim.TermMax,
+			FirstSeen: height,
+		}
+		ca.claimOnly[claimKey{provider: provider, id: claimID}] = rec
+	}
+	rec.State = AllocationClaimed
+	rec.ClaimID = claimID
+	rec.TermStart = claim.TermStart
+	rec.Sector = claim.Sector
+	rec.UpdatedAt = height
+}
+
+// serveClientAllocations lists a client's allocations, state= keeps only pending, claimed, expired or removed
+func serveClientAllocations(c *gin.Context) {
+	addr := c.Param("addr")
+	state := AllocationState(c.Query("state"))
+
+	allocations.lk.RLock()
+	defer allocations.lk.RUnlock()
+	if allocations.height == 0 {
+		err := ErrAllocationsNotReady
+		if allocations.lastErr != nil {
+			err = errors.Wrap(allocations.lastErr, err.Error())
+		}
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+
+	var ca *clientAllocations
+	for _, client := range allocations.view {
+		if client.Client == addr || (client.IDAddress != "" && client.IDAddress == addr) {
+			ca = client
+			break
+		}
+	}
+	if ca == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrNotOurClient.Error()})
+		return
+	}
+
+	resp := clientAllocations{Client: ca.Client, IDAddress: ca.IDAddress, Height: ca.Height, Records: []*AllocationRecord{}}
+	for _, rec := range ca.Records {
+		if state == "" || rec.State == state {
+			resp.Records = append(resp.Records, rec)
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
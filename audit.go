@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glifio/go-logger"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// AuditSinkKind picks where audit events are written
+type AuditSinkKind string
+
+const (
+	// StdoutAuditSink prints events as JSON lines and keeps the latest in memory for /admin/audit
+	StdoutAuditSink AuditSinkKind = "STDOUT"
+	// FileAuditSink appends events as JSON lines to AUDIT_FILE
+	FileAuditSink AuditSinkKind = "FILE"
+	// DynamoAuditSink stores events in their own DynamoDB table, AUDIT_TABLE_NAME
+	DynamoAuditSink AuditSinkKind = "DYNAMO"
+)
+
+// Audit event types and grant decisions
+const (
+	AuditGrant = "grant"
+	AuditAdmin = "admin"
+
+	DecisionGranted  = "granted"
+	DecisionRejected = "rejected"
+)
+
+// auditRingSize is how many events the stdout sink can answer queries for
+const auditRingSize = 1000
+
+// AuditEvent is one grant decision or admin action
+type AuditEvent struct {
+	ID               string                 `json:"id"`
+	Type             string                 `json:"type"`
+	Time             time.Time              `json:"time"`
+	Mode             Mode                   `json:"mode,omitempty"`
+	UserID           string                 `json:"userID,omitempty"`
+	Provider         string                 `json:"provider,omitempty"`
+	ProviderUsername string                 `json:"providerUsername,omitempty"`
+	Address          string                 `json:"address,omitempty"`
+	ClientIP         string                 `json:"clientIP,omitempty"`
+	Decision         string                 `json:"decision,omitempty"`
+	Reason           string                 `json:"reason,omitempty"`
+	Amount           string                 `json:"amount,omitempty"`
+	Cid              string                 `json:"cid,omitempty"`
+	Admin            string                 `json:"admin,omitempty"`
+	Action           string                 `json:"action,omitempty"`
+	Details          map[string]interface{} `json:"details,omitempty"`
+}
+
+// AuditQuery filters events, empty fields match everything
+type AuditQuery struct {
+	Type     string
+	Mode     Mode
+	UserID   string
+	Address  string
+	Decision string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+func (q AuditQuery) matches(e AuditEvent) bool {
+	return (q.Type == "" || e.Type == q.Type) &&
+		(q.Mode == "" || e.Mode == q.Mode) &&
+		(q.UserID == "" || e.UserID == q.UserID) &&
+		(q.Address == "" || e.Address == q.Address) &&
+		(q.Decision == "" || e.Decision == q.Decision) &&
+		(q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || e.Time.Before(q.Until))
+}
+
+// auditSink stores audit events and answers queries over them
+type auditSink interface {
+	write(ctx context.Context, e AuditEvent) error
+	query(ctx context.Context, q AuditQuery) ([]AuditEvent, error)
+}
+
+var (
+	auditLk      sync.Mutex
+	auditStorage auditSink
+)
+
+// auditSinkFromEnv picks the sink on first use
+func auditSinkFromEnv() (auditSink, error) {
+	auditLk.Lock()
+	defer auditLk.Unlock()
+	if auditStorage != nil {
+		return auditStorage, nil
+	}
+
+	switch env.AuditSink {
+	case StdoutAuditSink, "":
+		auditStorage = &stdoutAuditSink{}
+	case FileAuditSink:
+		if env.AuditFile == "" {
+			return nil, errors.New("AUDIT_FILE is required with the FILE audit sink")
+		}
+		auditStorage = &fileAuditSink{path: env.AuditFile}
+	case DynamoAuditSink:
+		if env.AuditTableName == "" {
+			return nil, errors.New("AUDIT_TABLE_NAME is required with the DYNAMO audit sink")
+		}
+		auditStorage = dynamoAuditSink{}
+	default:
+		return nil, errors.Errorf("unknown audit sink %q", env.AuditSink)
+	}
+	return auditStorage, nil
+}
+
+// recordAudit writes an event, failures are logged and never fail the request
+func recordAudit(ctx context.Context, e AuditEvent) {
+	if e.ID == "" {
+		e.ID = uuid.New().String()
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	sink, err := auditSinkFromEnv()
+	if err == nil {
+		err = sink.write(ctx, e)
+	}
+	if err != nil {
+		b, _ := json.Marshal(e)
+		logger.Errorf("ERROR WRITING AUDIT EVENT: %v: %s", err, b)
+	}
+}
+
+func queryAudit(ctx context.Context, q AuditQuery) ([]AuditEvent, error) {
+	sink, err := auditSinkFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	events, err := sink.query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	// newest first
+	sort.Slice(events, func(i, j int) bool { return events[i].Time.After(events[j].Time) })
+	if q.Limit > 0 && len(events) > q.Limit {
+		events = events[:q.Limit]
+	}
+	return events, nil
+}
+
+// stdoutAuditSink prints JSON lines and remembers the last auditRingSize events
+type stdoutAuditSink struct {
+	lk   sync.Mutex
+	ring []AuditEvent
+	next int
+}
+
+func (s *stdoutAuditSink) write(ctx context.Context, e AuditEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stdout, string(b))
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if len(s.ring) < auditRingSize {
+		s.ring = append(s.ring, e)
+	} else {
+		s.ring[s.next] = e
+	}
+	s.next = (s.next + 1) % auditRingSize
+	return nil
+}
+
+func (s *stdoutAuditSink) query(ctx context.Context, q AuditQuery) ([]AuditEvent, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	var events []AuditEvent
+	for _, e := range s.ring {
+		if q.matches(e) {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+// fileAuditSink appends JSON lines to a file, queries read it back
+type fileAuditSink struct {
+	lk   sync.Mutex
+	path string
+}
+
+func (s *fileAuditSink) write(ctx context.Context, e AuditEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *fileAuditSink) query(ctx context.Context, q AuditQuery) ([]AuditEvent, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if q.matches(e) {
+			events = append(events, e)
+		}
+	}
+	return events, scanner.Err()
+}
+
+// dynamoAuditSink stores events in AUDIT_TABLE_NAME, keyed by ID
+type dynamoAuditSink struct{}
+
+func (dynamoAuditSink) write(ctx context.Context, e AuditEvent) error {
+	return saveAuditEvent(ctx, e)
+}
+
+func (dynamoAuditSink) query(ctx context.Context, q AuditQuery) ([]AuditEvent, error) {
+	return getAuditEvents(ctx, q)
+}
+
+// grantDecision collects what is known about a faucet or verifier request as the handler goes, and
+// records the outcome once
+type grantDecision struct {
+	c     *gin.Context
+	event AuditEvent
+}
+
+func newGrantDecision(c *gin.Context, mode Mode) *grantDecision {
+	grantRequests.WithLabelValues(string(mode)).Inc()
+	return &grantDecision{c: c, event: AuditEvent{
+		Type:     AuditGrant,
+		Mode:     mode,
+		Address:  c.Param("target_addr"),
+		ClientIP: c.ClientIP(),
+	}}
+}
+
+func (d *grantDecision) setUser(user User) {
+	d.event.UserID = user.ID
+	for provider, account := range user.Accounts {
+		d.event.Provider = provider
+		d.event.ProviderUsername = account.Username
+	}
+}
+
+// reject records a rejection, reason is a short snake_case label also used in the metrics
+func (d *grantDecision) reject(reason string) {
+	grantRejected(d.event.Mode, reason)
+	d.event.Decision = DecisionRejected
+	d.event.Reason = reason
+	recordAudit(detachedContext(d.c), d.event)
+}
+
+func (d *grantDecision) grant(amount, msgCid string) {
+	grantsGranted.WithLabelValues(string(d.event.Mode)).Inc()
+	d.event.Decision = DecisionGranted
+	d.event.Amount = amount
+	d.event.Cid = msgCid
+	recordAudit(detachedContext(d.c), d.event)
+}
+
+// parseAuditQuery reads the /admin/audit query string
+func parseAuditQuery(c *gin.Context) (AuditQuery, error) {
+	q := AuditQuery{
+		Type:     c.Query("type"),
+		UserID:   c.Query("user"),
+		Address:  c.Query("address"),
+		Decision: c.Query("decision"),
+		Limit:    100,
+	}
+	if m := c.Query("mode"); m != "" {
+		mode, _, err := parseMode(m)
+		if err != nil {
+			return q, err
+		}
+		q.Mode = mode
+	}
+	for _, t := range []struct {
+		param string
+		dst   *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if v := c.Query(t.param); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return q, errors.Wrapf(err, "parsing %v", t.param)
+			}
+			*t.dst = parsed
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		if _, err := fmt.Sscanf(v, "%d", &q.Limit); err != nil || q.Limit <= 0 {
+			return q, errors.New("limit must be a positive number")
+		}
+	}
+	return q, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDynamoAuditSinkUsesItsOwnTable(t *testing.T) {
+	fake := newFakeDynamo()
+	dynamoClient = fake
+	sink, table := env.AuditSink, env.AuditTableName
+	env.AuditSink, env.AuditTableName = DynamoAuditSink, "audit"
+	auditStorage = nil
+	defer func() {
+		dynamoClient = nil
+		env.AuditSink, env.AuditTableName = sink, table
+		auditStorage = nil
+	}()
+
+	ctx := context.Background()
+	recordAudit(ctx, AuditEvent{Type: AuditGrant, UserID: "u1", Decision: DecisionGranted})
+	recordAudit(ctx, AuditEvent{Type: AuditAdmin, Admin: "ops", Action: "user.unlock"})
+
+	events, err := queryAudit(ctx, AuditQuery{Type: AuditGrant})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].UserID != "u1" {
+		t.Fatalf("expected the grant event, got %v", events)
+	}
+	if n := len(fake.tables[env.DynamodbTableName]); n != 0 {
+		t.Fatalf("expected no audit events in the users table, got %d items", n)
+	}
+	if n := len(fake.tables["audit"]); n != 2 {
+		t.Fatalf("expected both events in the audit table, got %d", n)
+	}
+
+	env.AuditTableName = ""
+	auditStorage = nil
+	if _, err := auditSinkFromEnv(); err == nil {
+		t.Fatal("expected the DYNAMO sink to require AUDIT_TABLE_NAME")
+	}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	awscreds "github.com/aws/aws-sdk-go/aws/credentials"
 	awssession "github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/google/uuid"
 	"github.com/guregu/dynamo"
 )
@@ -23,6 +28,8 @@ type User struct {
 	ReceivedFaucetGrant         bool
 	Locked_Faucet               bool
 	Locked_Verifier             bool
+	MostRecentMsigTxnID         string
+	MostRecentMsigApproveCid    string
 }
 
 type AccountData struct {
@@ -41,30 +48,38 @@ func (user User) HasAccountOlderThan(threshold time.Duration) bool {
 	return false
 }
 
+// dynamoClient replaces the AWS client when set, the tests run the handlers against an in-memory table with it
+var dynamoClient dynamodbiface.DynamoDBAPI
+
 func dynamoTable(name string) dynamo.Table {
+	if dynamoClient != nil {
+		return dynamo.NewFromIface(dynamoClient).Table(name)
+	}
 	awsConfig := aws.NewConfig().
 		WithRegion(env.AWSRegion).
 		WithCredentials(awscreds.NewStaticCredentials(env.AWSAccessKey, env.AWSSecretKey, ""))
 
-	return dynamo.New(awssession.New(), awsConfig).Table(env.DynamodbTableName)
+	sess := awssession.New()
+	traceAWSRequests(sess)
+	return dynamo.New(sess, awsConfig).Table(name)
 }
 
-func getUserByID(userID string) (User, error) {
+func getUserByID(ctx context.Context, userID string) (User, error) {
 	table := dynamoTable(env.DynamodbTableName)
 
 	var user User
-	err := table.Get("ID", userID).One(&user)
+	err := table.Get("ID", userID).OneWithContext(ctx, &user)
 	return user, err
 }
 
-func getUserWithProviderUniqueID(providerName, uniqueID string) (User, error) {
+func getUserWithProviderUniqueID(ctx context.Context, providerName, uniqueID string) (User, error) {
 	table := dynamoTable(env.DynamodbTableName)
 
 	var users []User
 	err := table.Scan().
 		Filter("Accounts."+providerName+".UniqueID = ?", uniqueID).
 		Limit(1).
-		All(&users)
+		AllWithContext(ctx, &users)
 	if err != nil {
 		return User{}, err
 	}
@@ -79,35 +94,35 @@ func getUserWithProviderUniqueID(providerName, uniqueID string) (User, error) {
 	return user, nil
 }
 
-func lockUser(userID string, lock UserLock) error {
+func lockUser(ctx context.Context, userID string, lock UserLock) error {
 	table := dynamoTable(env.DynamodbTableName)
 	return table.Update("ID", userID).
 		Set("Locked_"+string(lock), true).
 		If("'Locked_"+string(lock)+"' = ? OR attribute_not_exists(Locked_"+string(lock)+")", false).
-		Run()
+		RunWithContext(ctx)
 }
 
-func unlockUser(userID string, lock UserLock) error {
+func unlockUser(ctx context.Context, userID string, lock UserLock) error {
 	table := dynamoTable(env.DynamodbTableName)
 	return table.Update("ID", userID).
 		Set("Locked_"+string(lock), false).
 		If("'Locked_"+string(lock)+"' = ?", true).
-		Run()
+		RunWithContext(ctx)
 }
 
-func saveUser(user User) error {
+func saveUser(ctx context.Context, user User) error {
 	table := dynamoTable(env.DynamodbTableName)
-	return table.Put(user).Run()
+	return table.Put(user).RunWithContext(ctx)
 }
 
-func getUserByVerifiedFilecoinAddress(filecoinAddr string) (User, error) {
+func getUserByVerifiedFilecoinAddress(ctx context.Context, filecoinAddr string) (User, error) {
 	table := dynamoTable(env.DynamodbTableName)
 
 	var users []User
 	err := table.Scan().
 		Filter("MostRecentVerifiedAddress = ?", filecoinAddr).
 		Limit(1).
-		All(&users)
+		AllWithContext(ctx, &users)
 	if err != nil {
 		return User{}, err
 	}
@@ -118,12 +133,12 @@ func getUserByVerifiedFilecoinAddress(filecoinAddr string) (User, error) {
 	return users[0], nil
 }
 
-func getLockedUsers(lock UserLock) ([]User, error) {
+func getLockedUsers(ctx context.Context, lock UserLock) ([]User, error) {
 	table := dynamoTable(env.DynamodbTableName)
 	var users []User
 	err := table.Scan().
 		Filter("Locked_"+string(lock)+" = ?", true).
-		All(&users)
+		AllWithContext(ctx, &users)
 	if err != nil {
 		var empty []User
 		return empty, err
@@ -131,3 +146,309 @@ func getLockedUsers(lock UserLock) ([]User, error) {
 
 	return users, nil
 }
+
+// getUsersWithDataCapGrant returns every user that was sent datacap at least once
+func getUsersWithDataCapGrant(ctx context.Context) ([]User, error) {
+	table := dynamoTable(env.DynamodbTableName)
+	var users []User
+	err := table.Scan().
+		Filter("attribute_exists(MostRecentDataCapCid)").
+		AllWithContext(ctx, &users)
+	return users, err
+}
+
+func getUsersByAddress(ctx context.Context, filecoinAddr string) ([]User, error) {
+	table := dynamoTable(env.DynamodbTableName)
+	var users []User
+	err := table.Scan().
+		Filter("MostRecentVerifiedAddress = ? OR MostRecentFaucetAddress = ?", filecoinAddr, filecoinAddr).
+		AllWithContext(ctx, &users)
+	return users, err
+}
+
+func getUsersByProviderUsername(ctx context.Context, providerName, username string) ([]User, error) {
+	table := dynamoTable(env.DynamodbTableName)
+	var users []User
+	err := table.Scan().
+		Filter("Accounts."+providerName+".Username = ?", username).
+		AllWithContext(ctx, &users)
+	return users, err
+}
+
+// GrantStatus follows a grant message from the mempool to its receipt
+type GrantStatus string
+
+const (
+	GrantPending GrantStatus = "PENDING"
+	// GrantIncluded is on chain but less than CONFIRMATION_DEPTH epochs deep, a reorg sends it back to pending
+	GrantIncluded  GrantStatus = "INCLUDED"
+	GrantConfirmed GrantStatus = "CONFIRMED"
+	GrantFailed    GrantStatus = "FAILED"
+)
+
+// grantIDPrefix keeps grant records apart from users in the same table
+const grantIDPrefix = "GRANT#"
+
+// Grant is one faucet or datacap message sent on behalf of a user
+type Grant struct {
+	ID        string
+	Mode      Mode
+	UserID    string
+	Address   string
+	Amount    string
+	Cid       string
+	Status    GrantStatus
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// Miner is the miner ID a faucet grant was made for, Address is then its owner or worker
+	Miner string
+	// Height is the epoch the message was executed at, once it is on chain
+	Height abi.ChainEpoch
+	// Backfilled grants were made before grants were recorded, and recovered from the user's last grant
+	Backfilled bool
+}
+
+func newGrant(mode Mode, userID, addr, amount, msgCid string) Grant {
+	now := time.Now()
+	return Grant{
+		ID:        grantIDPrefix + msgCid,
+		Mode:      mode,
+		UserID:    userID,
+		Address:   addr,
+		Amount:    amount,
+		Cid:       msgCid,
+		Status:    GrantPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+func saveGrant(ctx context.Context, grant Grant) error {
+	table := dynamoTable(env.DynamodbTableName)
+	return table.Put(grant).RunWithContext(ctx)
+}
+
+// saveGrantIfMissing never overwrites the record of a grant, it's for grants recorded after the fact
+func saveGrantIfMissing(ctx context.Context, grant Grant) error {
+	table := dynamoTable(env.DynamodbTableName)
+	err := table.Put(grant).If("attribute_not_exists(ID)").RunWithContext(ctx)
+	if isConditionalCheckFailed(err) {
+		return nil
+	}
+	return err
+}
+
+func getGrant(ctx context.Context, msgCid string) (Grant, error) {
+	table := dynamoTable(env.DynamodbTableName)
+
+	var grant Grant
+	err := table.Get("ID", grantIDPrefix+msgCid).OneWithContext(ctx, &grant)
+	return grant, err
+}
+
+// setGrantStatus ignores messages without a record, they were sent before grants were recorded
+func setGrantStatus(ctx context.Context, msgCid string, status GrantStatus) error {
+	return setGrantStatusByID(ctx, grantIDPrefix+msgCid, status)
+}
+
+// setGrantStatusByID is setGrantStatus for grants recorded before their message was pushed, like refills
+func setGrantStatusByID(ctx context.Context, id string, status GrantStatus) error {
+	table := dynamoTable(env.DynamodbTableName)
+	err := table.Update("ID", id).
+		Set("Status", status).
+		Set("UpdatedAt", time.Now()).
+		If("attribute_exists(ID)").
+		RunWithContext(ctx)
+	if isConditionalCheckFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// newRefillGrant is recorded before the refill is pushed, so its ID can't be the message CID
+func newRefillGrant(faucetAddr, amount string) Grant {
+	grant := newGrant(RefillMode, refillUserID, faucetAddr, amount, "")
+	grant.ID = grantIDPrefix + string(RefillMode) + "#" + uuid.New().String()
+	return grant
+}
+
+// setGrantCid fills in the message CID of a grant recorded before its message was pushed
+func setGrantCid(ctx context.Context, id, msgCid string) error {
+	table := dynamoTable(env.DynamodbTableName)
+	return table.Update("ID", id).
+		Set("Cid", msgCid).
+		Set("UpdatedAt", time.Now()).
+		If("attribute_exists(ID)").
+		RunWithContext(ctx)
+}
+
+// setGrantIncluded records that a grant message is on chain at height, while it isn't deep enough to be final
+func setGrantIncluded(ctx context.Context, msgCid string, height abi.ChainEpoch) error {
+	table := dynamoTable(env.DynamodbTableName)
+	err := table.Update("ID", grantIDPrefix+msgCid).
+		Set("Status", GrantIncluded).
+		Set("Height", height).
+		Set("UpdatedAt", time.Now()).
+		If("attribute_exists(ID) AND 'Status' IN (?, ?)", GrantPending, GrantIncluded).
+		RunWithContext(ctx)
+	if isConditionalCheckFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// revertGrantIncluded moves an included grant back to pending, after a reorg took its message off the chain.
+// It reports whether the grant was included.
+func revertGrantIncluded(ctx context.Context, msgCid string) (bool, error) {
+	table := dynamoTable(env.DynamodbTableName)
+	err := table.Update("ID", grantIDPrefix+msgCid).
+		Set("Status", GrantPending).
+		Remove("Height").
+		Set("UpdatedAt", time.Now()).
+		If("'Status' = ?", GrantIncluded).
+		RunWithContext(ctx)
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func getGrants(ctx context.Context, mode Mode, status GrantStatus) ([]Grant, error) {
+	table := dynamoTable(env.DynamodbTableName)
+
+	scan := table.Scan().Filter("begins_with(ID, ?)", grantIDPrefix)
+	if mode != "" {
+		scan = scan.Filter("'Mode' = ?", mode)
+	}
+	if status != "" {
+		scan = scan.Filter("'Status' = ?", status)
+	}
+
+	var grants []Grant
+	err := scan.AllWithContext(ctx, &grants)
+	return grants, err
+}
+
+// minerSlotsIDPrefix keeps the per-miner faucet limits apart from users and grants
+const minerSlotsIDPrefix = "MINER#"
+
+// minerSlotsRetries bounds how often a slot update is retried when another request got there first
+const minerSlotsRetries = 5
+
+var errMinerSlotsTaken = errors.New("every faucet grant slot of this miner is taken")
+
+// MinerSlots holds when each recent faucet grant to a miner was reserved, keyed by reservation. Version
+// makes every update conditional on the record it was computed from.
+type MinerSlots struct {
+	ID      string
+	Slots   map[string]time.Time
+	Version int
+}
+
+// updateMinerSlots applies fn to the miner's slots and writes them back only if nobody else did meanwhile,
+// retrying a few times when someone did
+func updateMinerSlots(ctx context.Context, miner string, fn func(slots map[string]time.Time) error) error {
+	table := dynamoTable(env.DynamodbTableName)
+	id := minerSlotsIDPrefix + miner
+
+	for i := 0; i < minerSlotsRetries; i++ {
+		var ms MinerSlots
+		err := table.Get("ID", id).OneWithContext(ctx, &ms)
+		if err != nil && err != dynamo.ErrNotFound {
+			return err
+		}
+		if ms.Slots == nil {
+			ms.Slots = map[string]time.Time{}
+		}
+		if err := fn(ms.Slots); err != nil {
+			return err
+		}
+
+		put := table.Put(MinerSlots{ID: id, Slots: ms.Slots, Version: ms.Version + 1})
+		if ms.Version == 0 {
+			put = put.If("attribute_not_exists(ID)")
+		} else {
+			put = put.If("'Version' = ?", ms.Version)
+		}
+		err = put.RunWithContext(ctx)
+		if !isConditionalCheckFailed(err) {
+			return err
+		}
+	}
+	return errors.Errorf("too many concurrent faucet requests for miner %v", miner)
+}
+
+// reserveMinerSlot takes one of the max grants a miner gets within window, or returns errMinerSlotsTaken.
+// The returned key gives the slot back with releaseMinerSlot.
+func reserveMinerSlot(ctx context.Context, miner string, max int, window time.Duration) (string, error) {
+	key := uuid.New().String()
+	err := updateMinerSlots(ctx, miner, func(slots map[string]time.Time) error {
+		now := time.Now()
+		for k, reservedAt := range slots {
+			if now.Sub(reservedAt) >= window {
+				delete(slots, k)
+			}
+		}
+		if len(slots) >= max {
+			return errMinerSlotsTaken
+		}
+		slots[key] = now
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// releaseMinerSlot gives back a slot whose grant was never sent
+func releaseMinerSlot(ctx context.Context, miner, key string) error {
+	return updateMinerSlots(ctx, miner, func(slots map[string]time.Time) error {
+		delete(slots, key)
+		return nil
+	})
+}
+
+func isConditionalCheckFailed(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+	}
+	return false
+}
+
+// saveAuditEvent stores an event in AUDIT_TABLE_NAME, so the user lookups never scan over them
+func saveAuditEvent(ctx context.Context, event AuditEvent) error {
+	table := dynamoTable(env.AuditTableName)
+	return table.Put(event).RunWithContext(ctx)
+}
+
+func getAuditEvents(ctx context.Context, q AuditQuery) ([]AuditEvent, error) {
+	table := dynamoTable(env.AuditTableName)
+
+	scan := table.Scan()
+	if q.Type != "" {
+		scan = scan.Filter("'Type' = ?", q.Type)
+	}
+	if q.Mode != "" {
+		scan = scan.Filter("'Mode' = ?", q.Mode)
+	}
+	if q.UserID != "" {
+		scan = scan.Filter("UserID = ?", q.UserID)
+	}
+	if q.Address != "" {
+		scan = scan.Filter("Address = ?", q.Address)
+	}
+
+	var events []AuditEvent
+	if err := scan.AllWithContext(ctx, &events); err != nil {
+		return nil, err
+	}
+
+	matching := events[:0]
+	for _, e := range events {
+		if q.matches(e) {
+			matching = append(matching, e)
+		}
+	}
+	return matching, nil
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/filecoin-project/go-address"
 	"github.com/glifio/go-logger"
+	"github.com/pkg/errors"
 )
 
+var ErrBlockedByEnv = errors.New("the address is in BLOCKED_ADDRESSES, remove it there and restart to unblock it")
+
 var blocklist = make(map[address.Address]bool)
+var blocklistLk sync.RWMutex
 
 // cache the blocklist as a map in memory with faster lookups than reading the file everytime
 func initBlockListCache() error {
@@ -15,6 +22,9 @@ func initBlockListCache() error {
 		return nil
 	}
 
+	blocklistLk.Lock()
+	defer blocklistLk.Unlock()
+
 	for _, e := range strings.Split(env.BlockedAddresses, ",") {
 		logger.Debugf("Adding %v to blocklist.", e)
 		targetAddr, err := address.NewFromString(e)
@@ -27,10 +37,85 @@ func initBlockListCache() error {
 	return nil
 }
 
+// blocklistKey is the redis set holding the addresses blocked at runtime, so every replica sees them
+func blocklistKey() string {
+	return env.DynamodbTableName + ":BLOCKLIST"
+}
+
 func isAddressBlocked(address address.Address) bool {
+	blocklistLk.RLock()
 	blocked := blocklist[address]
+	blocklistLk.RUnlock()
+
+	if !blocked && redisEnabled() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var err error
+		blocked, err = getRedis().SIsMember(ctx, blocklistKey(), address.String()).Result()
+		if err != nil {
+			logger.Errorf("REDIS BLOCKLIST LOOKUP FAILED: %v", err)
+		}
+	}
+
 	if blocked {
 		logger.Debugf("Blocked address: %v", address.String())
 	}
 	return blocked
 }
+
+func blockAddress(ctx context.Context, addr address.Address) error {
+	if redisEnabled() {
+		return getRedis().SAdd(ctx, blocklistKey(), addr.String()).Err()
+	}
+	blocklistLk.Lock()
+	defer blocklistLk.Unlock()
+	blocklist[addr] = true
+	return nil
+}
+
+// envBlocked tells whether addr is in BLOCKED_ADDRESSES, only a restart can unblock those
+func envBlocked(addr address.Address) bool {
+	if len(env.BlockedAddresses) == 0 {
+		return false
+	}
+	for _, e := range strings.Split(env.BlockedAddresses, ",") {
+		if a, err := address.NewFromString(e); err == nil && a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func unblockAddress(ctx context.Context, addr address.Address) error {
+	if envBlocked(addr) {
+		return ErrBlockedByEnv
+	}
+
+	blocklistLk.Lock()
+	delete(blocklist, addr)
+	blocklistLk.Unlock()
+
+	if redisEnabled() {
+		return getRedis().SRem(ctx, blocklistKey(), addr.String()).Err()
+	}
+	return nil
+}
+
+func listBlockedAddresses(ctx context.Context) ([]string, error) {
+	blocklistLk.RLock()
+	var addrs []string
+	for addr := range blocklist {
+		addrs = append(addrs, addr.String())
+	}
+	blocklistLk.RUnlock()
+
+	if redisEnabled() {
+		members, err := getRedis().SMembers(ctx, blocklistKey()).Result()
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, members...)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/robfig/cron.v2"
+)
+
+const cliUsage = `usage: verifier <command> [flags]
+
+commands:
+  serve                                      start the HTTP server (default)
+  users show <user ID> | -address a | -github u
+  grants list [-mode m] [-status s]
+  reconcile [-once] [-mode m]
+  counter <show|reset|adjust> [-budget b -delta n]
+  blocklist <list|add|remove> [address]
+  locked <list|unlock|fail|redrive> [-mode m] [-force] [user ID]`
+
+// runCommand runs an operator subcommand against the same state the server uses and returns the exit code
+func runCommand(args []string) int {
+	var err error
+	switch args[0] {
+	case "serve":
+		err = serve()
+	case "users":
+		return runUsersCommand(args[1:])
+	case "grants":
+		return runGrantsCommand(args[1:])
+	case "reconcile":
+		return runReconcileCommand(args[1:])
+	case "counter":
+		return runCounterCommand(args[1:])
+	case "blocklist":
+		return runBlocklistCommand(args[1:])
+	case "locked":
+		return runLockedCommand(args[1:])
+	case "help", "-h", "--help":
+		fmt.Println(cliUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n%s\n", args[0], cliUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// cliAdmin names the operator in the admin audit log
+func cliAdmin() string {
+	return "cli:" + os.Getenv("USER")
+}
+
+func cliFail(err error) int {
+	fmt.Fprintln(os.Stderr, err)
+	return 1
+}
+
+func cliUsageError(usage string) int {
+	fmt.Fprintln(os.Stderr, usage)
+	return 2
+}
+
+func printJSON(v interface{}) int {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return cliFail(err)
+	}
+	fmt.Println(string(b))
+	return 0
+}
+
+func runUsersCommand(args []string) int {
+	usage := "usage: verifier users show <user ID> | -address <filecoin address> | -github <username>"
+	if len(args) == 0 || args[0] != "show" {
+		return cliUsageError(usage)
+	}
+
+	fs := flag.NewFlagSet("users show", flag.ContinueOnError)
+	addr := fs.String("address", "", "most recent verified or faucet address")
+	github := fs.String("github", "", "GitHub username")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	switch {
+	case *addr != "":
+		users, err := getUsersByAddress(context.Background(), *addr)
+		if err != nil {
+			return cliFail(err)
+		}
+		return printJSON(users)
+	case *github != "":
+		users, err := getUsersByProviderUsername(context.Background(), "github", *github)
+		if err != nil {
+			return cliFail(err)
+		}
+		return printJSON(users)
+	case fs.NArg() == 1:
+		user, err := getUserByID(context.Background(), fs.Arg(0))
+		if err != nil {
+			return cliFail(err)
+		}
+		return printJSON(user)
+	}
+	return cliUsageError(usage)
+}
+
+func runGrantsCommand(args []string) int {
+	usage := "usage: verifier grants list [-mode faucet|verifier|refill] [-status PENDING|INCLUDED|CONFIRMED|FAILED]"
+	if len(args) == 0 || args[0] != "list" {
+		return cliUsageError(usage)
+	}
+
+	fs := flag.NewFlagSet("grants list", flag.ContinueOnError)
+	modeFlag := fs.String("mode", "", "faucet, verifier or refill, all when empty")
+	status := fs.String("status", "", "only grants with this status")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	var mode Mode
+	if strings.ToUpper(*modeFlag) == string(RefillMode) {
+		mode = RefillMode
+	} else if *modeFlag != "" {
+		var err error
+		if mode, _, err = parseMode(*modeFlag); err != nil {
+			return cliUsageError(usage)
+		}
+	}
+
+	grants, err := getGrants(context.Background(), mode, GrantStatus(*status))
+	if err != nil {
+		return cliFail(err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CREATED\tMODE\tUSER ID\tADDRESS\tAMOUNT\tCID\tSTATUS")
+	for _, g := range grants {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", g.CreatedAt.Format(time.RFC3339), g.Mode, g.UserID, g.Address, g.Amount, g.Cid, g.Status)
+	}
+	tw.Flush()
+	return 0
+}
+
+// runReconcileCommand runs the reconcile jobs once, or on the server's schedule until interrupted
+func runReconcileCommand(args []string) int {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	once := fs.Bool("once", false, "reconcile once and exit")
+	modeFlag := fs.String("mode", "", "faucet or verifier, both when empty")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var jobs []func()
+	switch *modeFlag {
+	case "":
+		jobs = []func(){reconcileFaucetMessages, reconcileVerifierMessages}
+	default:
+		mode, _, err := parseMode(*modeFlag)
+		if err != nil {
+			return cliFail(err)
+		}
+		if mode == FaucetMode {
+			jobs = []func(){reconcileFaucetMessages}
+		} else {
+			jobs = []func(){reconcileVerifierMessages}
+		}
+	}
+
+	// the multisig proposals are followed and approved with the notary's keys, like in the server
+	ctx := context.Background()
+	if err := signers.load(ctx); err != nil {
+		return cliFail(err)
+	}
+	defer signers.close()
+	if err := initMsig(ctx); err != nil {
+		return cliFail(err)
+	}
+
+	if *once {
+		for _, job := range jobs {
+			job()
+		}
+		return 0
+	}
+
+	c := cron.New()
+	for _, job := range jobs {
+		c.AddFunc("@hourly", job)
+	}
+	c.Start()
+	defer c.Stop()
+	select {}
+}
+
+func runCounterCommand(args []string) int {
+	usage := "usage: verifier counter <show|reset|adjust -budget COUNT|BYTES|NANOFIL -delta n>"
+	if len(args) == 0 {
+		return cliUsageError(usage)
+	}
+
+	fs := flag.NewFlagSet("counter "+args[0], flag.ContinueOnError)
+	budgetName := fs.String("budget", "COUNT", "budget to adjust")
+	delta := fs.Int64("delta", 0, "signed amount to move the current window by")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := initCounter(); err != nil {
+		return cliFail(err)
+	}
+	if err := pingCounter(ctx); err != nil {
+		return cliFail(err)
+	}
+
+	switch args[0] {
+	case "show":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "BUDGET\tUSED\tLIMIT\t(%s window)\n", env.AllocationsWindow)
+		for _, b := range allBudgets() {
+			if !b.enabled() {
+				continue
+			}
+			used, err := b.used(ctx)
+			if err != nil {
+				return cliFail(err)
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%d\t\n", b.name, used, b.limit)
+		}
+		tw.Flush()
+		return 0
+	case "reset":
+		if err := resetCounter(ctx); err != nil {
+			return cliFail(err)
+		}
+		recordAdminAction(cliAdmin(), "", "counter.reset", nil)
+		return 0
+	case "adjust":
+		b, ok := budgetByName(*budgetName)
+		if !ok || *delta == 0 {
+			return cliUsageError(usage)
+		}
+		if err := b.adjust(ctx, *delta); err != nil {
+			return cliFail(err)
+		}
+		recordAdminAction(cliAdmin(), "", "counter.adjust", gin.H{"budget": b.name, "delta": *delta})
+		return 0
+	}
+	return cliUsageError(usage)
+}
+
+func runBlocklistCommand(args []string) int {
+	usage := "usage: verifier blocklist <list|add|remove> [address]"
+	if len(args) == 0 {
+		return cliUsageError(usage)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if args[0] == "list" {
+		if err := initBlockListCache(); err != nil {
+			return cliFail(err)
+		}
+		addrs, err := listBlockedAddresses(ctx)
+		if err != nil {
+			return cliFail(err)
+		}
+		for _, a := range addrs {
+			fmt.Println(a)
+		}
+		return 0
+	}
+
+	if len(args) != 2 {
+		return cliUsageError(usage)
+	}
+	if !redisEnabled() {
+		return cliFail(fmt.Errorf("REDIS_ENDPOINT is required to change the blocklist of a running server"))
+	}
+	addr, err := address.NewFromString(args[1])
+	if err != nil {
+		return cliFail(err)
+	}
+
+	switch args[0] {
+	case "add":
+		err = blockAddress(ctx, addr)
+	case "remove":
+		err = unblockAddress(ctx, addr)
+	default:
+		return cliUsageError(usage)
+	}
+	if err != nil {
+		return cliFail(err)
+	}
+	recordAdminAction(cliAdmin(), "", "blocklist."+args[0], gin.H{"address": addr.String()})
+	return 0
+}
+
+func runLockedCommand(args []string) int {
+	usage := "usage: verifier locked <list|unlock|fail|redrive> [-mode faucet|verifier] [-force] [user ID]"
+	if len(args) == 0 {
+		return cliUsageError(usage)
+	}
+
+	fs := flag.NewFlagSet("locked "+args[0], flag.ContinueOnError)
+	modeFlag := fs.String("mode", "verifier", "faucet or verifier")
+	force := fs.Bool("force", false, "re-drive even when the last message was not found on chain")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	_, lock, err := parseMode(*modeFlag)
+	if err != nil {
+		return cliUsageError(usage)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	if args[0] == "list" {
+		grants, err := listLockedGrants(ctx, lock)
+		if err != nil {
+			return cliFail(err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "USER ID\tUSERNAME\tADDRESS\tCID\tCHAIN STATUS\tEXIT CODE\tERROR")
+		for _, g := range grants {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", g.UserID, g.Username, g.Address, g.Cid, g.ChainStatus, g.ExitCode, g.Error)
+		}
+		tw.Flush()
+		return 0
+	}
+
+	if fs.NArg() != 1 {
+		return cliUsageError(usage)
+	}
+	userID := fs.Arg(0)
+
+	switch args[0] {
+	case "unlock":
+		if err := unlockUser(ctx, userID, lock); err != nil {
+			return cliFail(err)
+		}
+		recordAdminAction(cliAdmin(), "", "user.unlock", gin.H{"userID": userID, "lock": lock})
+	case "fail":
+		if err := failLockedGrant(ctx, userID, lock); err != nil {
+			return cliFail(err)
+		}
+		recordAdminAction(cliAdmin(), "", "grant.fail", gin.H{"userID": userID, "lock": lock})
+	case "redrive":
+		if err := signers.load(ctx); err != nil {
+			return cliFail(err)
+		}
+		defer signers.close()
+		if err := initMsig(ctx); err != nil {
+			return cliFail(err)
+		}
+		newCid, err := redriveLockedGrant(ctx, userID, lock, *force)
+		if err != nil {
+			return cliFail(err)
+		}
+		fmt.Println(newCid)
+		recordAdminAction(cliAdmin(), "", "grant.redrive", gin.H{"userID": userID, "lock": lock, "force": *force, "cid": newCid.String()})
+	default:
+		return cliUsageError(usage)
+	}
+	return 0
+}
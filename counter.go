@@ -2,87 +2,347 @@ package main
 
 import (
 	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/go-redis/redis/extra/redisotel/v8"
 	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
 )
 
-var partitionKey string
+// CounterWindow decides how budgets are bucketed over time
+type CounterWindow string
 
-func initRedis() *redis.Client {
-	return redis.NewClient(&redis.Options{
-			Addr: env.RedisEndpoint,
+const (
+	// DayWindow resets the budgets at midnight UTC
+	DayWindow CounterWindow = "DAY"
+	// RollingWindow counts what was handed out within the last ALLOCATIONS_ROLLING_WINDOW
+	RollingWindow CounterWindow = "ROLLING"
+)
+
+var errBudgetReached = errors.New("budget reached for the current window")
+
+// windowBudget caps how much can be handed out within a counter window
+type windowBudget struct {
+	name  string
+	limit int64
+}
+
+var (
+	// allocationsBudget caps the number of datacap grants
+	allocationsBudget = &windowBudget{name: "COUNT"}
+	// datacapBudget caps the bytes of datacap granted
+	datacapBudget = &windowBudget{name: "BYTES"}
+	// faucetBudget caps the nanoFIL sent by the faucet
+	faucetBudget = &windowBudget{name: "NANOFIL"}
+)
+
+// Reservation is held in a budget between pushing a message and knowing whether it failed
+type Reservation struct {
+	budget *windowBudget
+	key    string
+	member string
+	amount int64
+}
+
+// reserveDayScript adds to the budget for the day only while it stays within the limit
+var reserveDayScript = redis.NewScript(`
+local used = tonumber(redis.call('GET', KEYS[1]) or '0')
+if used + tonumber(ARGV[2]) > tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('INCRBY', KEYS[1], ARGV[2])
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+return 1
+`)
+
+// releaseDayScript gives an amount back without ever going below zero
+var releaseDayScript = redis.NewScript(`
+local used = tonumber(redis.call('GET', KEYS[1]) or '0')
+if used > 0 then
+	redis.call('DECRBY', KEYS[1], math.min(used, tonumber(ARGV[1])))
+end
+return 1
+`)
+
+// usedRollingScript drops the reservations that left the window and sums the rest,
+// members are stored as "<uuid>:<amount>"
+var usedRollingScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+local used = 0
+for _, member in ipairs(redis.call('ZRANGE', KEYS[1], 0, -1)) do
+	used = used + tonumber(string.match(member, ':(%d+)$'))
+end
+return used
+`)
+
+// reserveRollingScript is usedRollingScript followed by adding the reservation if there's room
+var reserveRollingScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[2])
+local used = 0
+for _, member in ipairs(redis.call('ZRANGE', KEYS[1], 0, -1)) do
+	used = used + tonumber(string.match(member, ':(%d+)$'))
+end
+if used + tonumber(ARGV[6]) > tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[4])
+redis.call('PEXPIRE', KEYS[1], ARGV[5])
+return 1
+`)
+
+// adjustDayScript moves the budget for the day by a signed delta without going below zero
+var adjustDayScript = redis.NewScript(`
+local used = tonumber(redis.call('GET', KEYS[1]) or '0')
+local adjusted = math.max(0, used + tonumber(ARGV[1]))
+redis.call('SET', KEYS[1], adjusted, 'EX', ARGV[2])
+return adjusted
+`)
+
+// shrinkRollingScript drops the oldest reservations until at least ARGV[1] was given back
+var shrinkRollingScript = redis.NewScript(`
+local remaining = tonumber(ARGV[1])
+for _, member in ipairs(redis.call('ZRANGE', KEYS[1], 0, -1)) do
+	if remaining <= 0 then
+		break
+	end
+	redis.call('ZREM', KEYS[1], member)
+	remaining = remaining - tonumber(string.match(member, ':(%d+)$'))
+end
+return 1
+`)
+
+func redisEnabled() bool {
+	return env.RedisEndpoint != ""
+}
+
+var (
+	redisOnce   sync.Once
+	redisClient *redis.Client
+)
+
+// getRedis returns the client shared by the whole process, so every call reuses its connection pool
+func getRedis() *redis.Client {
+	redisOnce.Do(func() {
+		redisClient = redis.NewClient(&redis.Options{
+			Addr:     env.RedisEndpoint,
 			Password: env.RedisPwd,
+		})
+		redisClient.AddHook(redisotel.NewTracingHook())
 	})
+	return redisClient
 }
 
-func initCounter(ctx context.Context) error {
-	if env.MaxTotalAllocations == 0 {
-		return nil
+// initCounter sets the budget limits from the environment. Every limit is checked before any is set, a
+// limit that was left unset would fail open since a zero limit means no budget.
+func initCounter() error {
+	if uint64(env.MaxTotalAllocations) > math.MaxInt64 {
+		return errors.Errorf("MAX_TOTAL_ALLOCATIONS %v is too large", env.MaxTotalAllocations)
 	}
-	partitionKey = env.DynamodbTableName + ":COUNT"
-	rdb := initRedis()
-
-	_, err := rdb.Get(ctx, partitionKey).Result()
-	if err != nil && err != redis.Nil {
-		return err
+	if !env.MaxWindowAllowanceBytes.IsInt64() {
+		return errors.Errorf("MAX_WINDOW_ALLOWANCE_BYTES %v is too large", env.MaxWindowAllowanceBytes)
 	}
-
-	if (err == redis.Nil) {
-		rdb.Set(ctx, partitionKey, 0, 0)
+	// a grant is reserved from the datacap budget as an int64, see reserveBudgets
+	if env.MaxAllowanceBytes.Int != nil && !env.MaxAllowanceBytes.IsInt64() {
+		return errors.Errorf("MAX_ALLOWANCE_BYTES %v is too large", env.MaxAllowanceBytes)
+	}
+	faucetLimit := filToNanoFIL(env.FaucetMaxWindowFIL)
+	if !faucetLimit.IsInt64() {
+		return errors.Errorf("FAUCET_MAX_WINDOW_FIL %v is too large", env.FaucetMaxWindowFIL)
+	}
+	if env.AllocationsWindow != DayWindow && env.AllocationsWindow != RollingWindow {
+		return errors.Errorf("unknown allocations window %q", env.AllocationsWindow)
 	}
 
+	allocationsBudget.limit = int64(env.MaxTotalAllocations)
+	datacapBudget.limit = env.MaxWindowAllowanceBytes.Int64()
+	faucetBudget.limit = faucetLimit.Int64()
 	return nil
 }
 
-func getCount(ctx context.Context) (uint, error) {
-	if env.MaxTotalAllocations == 0 {
+// pingCounter checks that redis answers, when there is a budget to keep in it
+func pingCounter(ctx context.Context) error {
+	if !allocationsBudget.enabled() && !datacapBudget.enabled() && !faucetBudget.enabled() {
+		return nil
+	}
+	return getRedis().Ping(ctx).Err()
+}
+
+// filToNanoFIL converts to the unit the faucet budget is kept in, so it fits in redis integers
+func filToNanoFIL(fil types.FIL) big.Int {
+	return big.Div(types.BigInt(fil), big.NewInt(1e9))
+}
+
+func (b *windowBudget) enabled() bool {
+	return b.limit > 0
+}
+
+// key returns the redis key of the window that contains now
+func (b *windowBudget) key(now time.Time) string {
+	prefix := env.DynamodbTableName + ":" + b.name
+	if env.AllocationsWindow == RollingWindow {
+		return prefix + ":ROLLING"
+	}
+	return prefix + ":" + now.UTC().Format("2006-01-02")
+}
+
+func (b *windowBudget) used(ctx context.Context) (int64, error) {
+	if !b.enabled() {
 		return 0, nil
 	}
-	rdb := initRedis()
-	val, err := rdb.Get(ctx, partitionKey).Uint64()
-	if err != nil {
-		// if theres an error, just return the count so no allocations get granted
-		return env.MaxTotalAllocations, err
+	rdb := getRedis()
+	now := time.Now()
+	key := b.key(now)
+
+	if env.AllocationsWindow == RollingWindow {
+		cutoff := now.Add(-env.AllocationsRollingWindow).UnixNano() / int64(time.Millisecond)
+		return usedRollingScript.Run(ctx, rdb, []string{key}, cutoff).Int64()
 	}
-	return uint(val), nil
+
+	val, err := rdb.Get(ctx, key).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return val, err
 }
 
-func reachedCounter(ctx context.Context) (bool, error) {
-	if env.MaxTotalAllocations == 0 {
-		return false, nil
+// reserve atomically takes amount out of the current window, or returns errBudgetReached when it doesn't fit
+func (b *windowBudget) reserve(ctx context.Context, amount int64) (*Reservation, error) {
+	if !b.enabled() {
+		return nil, nil
 	}
+	rdb := getRedis()
+	now := time.Now()
+	r := &Reservation{budget: b, key: b.key(now), amount: amount}
 
-	val, err := getCount(ctx)
+	var ok int64
+	var err error
+	if env.AllocationsWindow == RollingWindow {
+		r.member = uuid.New().String() + ":" + strconv.FormatInt(amount, 10)
+		nowMs := now.UnixNano() / int64(time.Millisecond)
+		windowMs := int64(env.AllocationsRollingWindow / time.Millisecond)
+		ok, err = reserveRollingScript.Run(ctx, rdb, []string{r.key},
+			b.limit, nowMs-windowMs, nowMs, r.member, windowMs, amount).Int64()
+	} else {
+		ok, err = reserveDayScript.Run(ctx, rdb, []string{r.key},
+			b.limit, amount, int64((48*time.Hour)/time.Second)).Int64()
+	}
 	if err != nil {
-		return true, err
+		return nil, err
+	}
+	if ok == 0 {
+		return nil, errBudgetReached
+	}
+	return r, nil
+}
+
+// release gives back an amount taken by reserve, e.g. when the message couldn't be pushed
+func (r *Reservation) release(ctx context.Context) error {
+	if r == nil {
+		return nil
 	}
+	rdb := getRedis()
+	if r.member != "" {
+		return rdb.ZRem(ctx, r.key, r.member).Err()
+	}
+	return releaseDayScript.Run(ctx, rdb, []string{r.key}, r.amount).Err()
+}
 
-	return val >= env.MaxTotalAllocations, nil
+func (b *windowBudget) reset(ctx context.Context) error {
+	if !b.enabled() {
+		return nil
+	}
+	rdb := getRedis()
+	return rdb.Del(ctx, b.key(time.Now())).Err()
 }
 
-func incrementCounter(ctx context.Context) error {
-	if env.MaxTotalAllocations == 0 {
+// adjust moves the current window by delta, ignoring the limit, for when the counter drifted from what was actually granted
+func (b *windowBudget) adjust(ctx context.Context, delta int64) error {
+	if !b.enabled() {
 		return nil
 	}
-	rdb := initRedis()
+	rdb := getRedis()
+	now := time.Now()
+	key := b.key(now)
 
-	val, err := getCount(ctx)
-	if err != nil {
-		return err
+	if env.AllocationsWindow != RollingWindow {
+		return adjustDayScript.Run(ctx, rdb, []string{key}, delta, int64((48*time.Hour)/time.Second)).Err()
 	}
-	err = rdb.Set(ctx, partitionKey, val + 1, 0).Err()
-	if err != nil {
+	if delta < 0 {
+		return shrinkRollingScript.Run(ctx, rdb, []string{key}, -delta).Err()
+	}
+	member := uuid.New().String() + ":" + strconv.FormatInt(delta, 10)
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	if err := rdb.ZAdd(ctx, key, &redis.Z{Score: float64(nowMs), Member: member}).Err(); err != nil {
 		return err
 	}
-	return nil
+	return rdb.PExpire(ctx, key, env.AllocationsRollingWindow).Err()
+}
+
+// budgetByName finds a budget from the name used in its redis key
+func budgetByName(name string) (*windowBudget, bool) {
+	for _, b := range allBudgets() {
+		if b.name == name {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+func allBudgets() []*windowBudget {
+	return []*windowBudget{allocationsBudget, datacapBudget, faucetBudget}
+}
+
+// budgetAmount pairs a budget with how much a single grant takes out of it
+type budgetAmount struct {
+	budget *windowBudget
+	amount int64
 }
 
-func resetCounter(ctx context.Context) (bool, error) {
-	rdb := initRedis()
+// reserveBudgets reserves every amount or none of them
+func reserveBudgets(ctx context.Context, amounts ...budgetAmount) ([]*Reservation, error) {
+	var reservations []*Reservation
+	for _, a := range amounts {
+		r, err := a.budget.reserve(ctx, a.amount)
+		if err != nil {
+			releaseBudgets(ctx, reservations)
+			return nil, errors.Wrap(err, a.budget.name)
+		}
+		reservations = append(reservations, r)
+	}
+	return reservations, nil
+}
+
+// releaseBudgets is best effort, a failed release only makes the window stricter than it should be
+func releaseBudgets(ctx context.Context, reservations []*Reservation) error {
+	var lastErr error
+	for _, r := range reservations {
+		if err := r.release(ctx); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
 
-	err := rdb.Set(ctx, partitionKey, 0, 0).Err()
+func getCount(ctx context.Context) (uint, error) {
+	val, err := allocationsBudget.used(ctx)
 	if err != nil {
-		return false, nil
+		// if theres an error, just return the count so no allocations get granted
+		return env.MaxTotalAllocations, err
+	}
+	return uint(val), nil
+}
+
+func resetCounter(ctx context.Context) error {
+	for _, b := range allBudgets() {
+		if err := b.reset(ctx); err != nil {
+			return err
+		}
 	}
-	return true, nil
-}
\ No newline at end of file
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// useMiniredis points the shared redis client at an in-memory server, which runs the budget scripts
+func useMiniredis(t *testing.T) *miniredis.Miniredis {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, window := env.RedisEndpoint, env.AllocationsWindow
+	env.RedisEndpoint = mr.Addr()
+	redisOnce, redisClient = sync.Once{}, nil
+	t.Cleanup(func() {
+		mr.Close()
+		env.RedisEndpoint, env.AllocationsWindow = endpoint, window
+		redisOnce, redisClient = sync.Once{}, nil
+	})
+	return mr
+}
+
+func testBudget(limit int64) *windowBudget {
+	return &windowBudget{name: "TEST", limit: limit}
+}
+
+func assertUsed(t *testing.T, b *windowBudget, want int64) {
+	t.Helper()
+	used, err := b.used(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != want {
+		t.Fatalf("expected %d used, got %d", want, used)
+	}
+}
+
+func TestInitCounterRejectsBadLimits(t *testing.T) {
+	tooLarge := big.Lsh(big.NewInt(1), 64)
+	for name, set := range map[string]func(){
+		"MAX_WINDOW_ALLOWANCE_BYTES": func() { env.MaxWindowAllowanceBytes = tooLarge },
+		"MAX_ALLOWANCE_BYTES":        func() { env.MaxAllowanceBytes = tooLarge },
+		"FAUCET_MAX_WINDOW_FIL":      func() { env.FaucetMaxWindowFIL = types.FIL(big.Lsh(big.NewInt(1), 100)) },
+		"ALLOCATIONS_WINDOW":         func() { env.AllocationsWindow = "WEEK" },
+	} {
+		saved := env
+		set()
+		for _, b := range allBudgets() {
+			b.limit = 7
+		}
+		if err := initCounter(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		env = saved
+		for _, b := range allBudgets() {
+			// no limit is set, not even the ones checked before the bad one
+			if b.limit != 7 {
+				t.Errorf("%s: expected the %s limit to be left alone, got %d", name, b.name, b.limit)
+			}
+			b.limit = 0
+		}
+	}
+}
+
+func TestDayBudget(t *testing.T) {
+	mr := useMiniredis(t)
+	env.AllocationsWindow = DayWindow
+	ctx := context.Background()
+	b := testBudget(10)
+
+	r, err := b.reserve(ctx, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.reserve(ctx, 6); err != errBudgetReached {
+		t.Fatalf("expected %v, got %v", errBudgetReached, err)
+	}
+	assertUsed(t, b, 6)
+	if ttl := mr.TTL(r.key); ttl <= 0 {
+		t.Fatalf("expected the window to expire, got a TTL of %v", ttl)
+	}
+
+	if err := r.release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	assertUsed(t, b, 0)
+	// releasing twice never goes below zero
+	if err := r.release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	assertUsed(t, b, 0)
+
+	if err := b.adjust(ctx, 4); err != nil {
+		t.Fatal(err)
+	}
+	assertUsed(t, b, 4)
+	if err := b.adjust(ctx, -100); err != nil {
+		t.Fatal(err)
+	}
+	assertUsed(t, b, 0)
+
+	// adjust ignores the limit
+	if err := b.adjust(ctx, 12); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.reserve(ctx, 1); err != errBudgetReached {
+		t.Fatalf("expected %v, got %v", errBudgetReached, err)
+	}
+}
+
+func TestRollingBudget(t *testing.T) {
+	useMiniredis(t)
+	env.AllocationsWindow = RollingWindow
+	rolling := env.AllocationsRollingWindow
+	env.AllocationsRollingWindow = time.Hour
+	defer func() { env.AllocationsRollingWindow = rolling }()
+	ctx := context.Background()
+	b := testBudget(10)
+
+	r, err := b.reserve(ctx, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.reserve(ctx, 6); err != errBudgetReached {
+		t.Fatalf("expected %v, got %v", errBudgetReached, err)
+	}
+	if _, err := b.reserve(ctx, 4); err != nil {
+		t.Fatal(err)
+	}
+	assertUsed(t, b, 10)
+
+	if err := r.release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	assertUsed(t, b, 4)
+
+	// shrinking drops the oldest reservations until enough was given back, they are ordered by the
+	// millisecond they were made in
+	time.Sleep(2 * time.Millisecond)
+	if err := b.adjust(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	assertUsed(t, b, 7)
+	if err := b.adjust(ctx, -4); err != nil {
+		t.Fatal(err)
+	}
+	assertUsed(t, b, 3)
+}
+
+func TestRollingBudgetExpires(t *testing.T) {
+	useMiniredis(t)
+	env.AllocationsWindow = RollingWindow
+	rolling := env.AllocationsRollingWindow
+	env.AllocationsRollingWindow = 50 * time.Millisecond
+	defer func() { env.AllocationsRollingWindow = rolling }()
+	ctx := context.Background()
+	b := testBudget(10)
+
+	if _, err := b.reserve(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.reserve(ctx, 1); err != errBudgetReached {
+		t.Fatalf("expected %v, got %v", errBudgetReached, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	assertUsed(t, b, 0)
+	if _, err := b.reserve(ctx, 10); err != nil {
+		t.Fatalf("expected the window to have moved past the first reservation: %v", err)
+	}
+}
+
+func TestWindowKeyRollover(t *testing.T) {
+	window := env.AllocationsWindow
+	defer func() { env.AllocationsWindow = window }()
+	b := testBudget(10)
+
+	env.AllocationsWindow = DayWindow
+	lastMinute := time.Date(2023, 1, 31, 23, 59, 0, 0, time.UTC)
+	if b.key(lastMinute) == b.key(lastMinute.Add(2*time.Minute)) {
+		t.Fatal("expected a new key after midnight UTC")
+	}
+	if b.key(lastMinute) != b.key(lastMinute.Add(-23*time.Hour)) {
+		t.Fatal("expected one key for the whole day")
+	}
+	// days are UTC days wherever the server runs
+	est := time.FixedZone("EST", -5*60*60)
+	if got, want := b.key(time.Date(2023, 1, 31, 20, 0, 0, 0, est)), env.DynamodbTableName+":TEST:2023-02-01"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	env.AllocationsWindow = RollingWindow
+	if b.key(lastMinute) != b.key(lastMinute.Add(2*time.Minute)) {
+		t.Fatal("expected the rolling window to keep one key")
+	}
+}
+
+func TestReservationReleasesItsOwnWindow(t *testing.T) {
+	mr := useMiniredis(t)
+	env.AllocationsWindow = DayWindow
+	ctx := context.Background()
+	b := testBudget(10)
+
+	// the day rolled over between the reservation and its release
+	yesterday := b.key(time.Now().Add(-24 * time.Hour))
+	r := &Reservation{budget: b, key: yesterday, amount: 6}
+	if err := mr.Set(yesterday, "6"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mr.Set(b.key(time.Now()), "5"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	assertUsed(t, b, 5)
+	if got, _ := mr.Get(yesterday); got != "0" {
+		t.Fatalf("expected yesterday's window to be released, got %q", got)
+	}
+}
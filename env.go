@@ -12,6 +12,7 @@ import (
 
 // Mode allows the backend to run in only verifier or faucet mode
 type Mode string
+
 const (
 	// FaucetMode runs just the faucet
 	FaucetMode Mode = "FAUCET"
@@ -21,36 +22,84 @@ const (
 
 // Env exports
 type Env struct {
-	Port                      string          `env:"PORT" envDefault:"8080"`
-	JWTSecret                 string          `env:"JWT_SECRET,required"`
-	AWSRegion                 string          `env:"AWS_REGION" envDefault:"us-east-1"`
-	AWSAccessKey              string          `env:"AWS_ACCESS_KEY,required"`
-	AWSSecretKey              string          `env:"AWS_SECRET_KEY,required"`
-	DynamodbTableName         string          `env:"DYNAMODB_TABLE_NAME,required"`
-	LotusAPIDialAddr          string          `env:"LOTUS_API_DIAL_ADDR,required"`
-	LotusAPIToken             string          `env:"LOTUS_API_TOKEN"`
-	BlockedAddresses          string          `env:"BLOCKED_ADDRESSES"`
-	GithubClientID            string          `env:"GITHUB_CLIENT_ID,required"`
-	GithubClientSecret        string          `env:"GITHUB_CLIENT_SECRET,required"`
-	SentryDsn                 string          `env:"SENTRY_DSN"`
-	SentryEnv                 string          `env:"SENTRY_ENV"`
-	MaxFee                    types.FIL       `env:"MAX_FEE" envDefault:"0afil"`
-	Mode                      Mode            `env:"MODE"`
+	Port                     string         `env:"PORT" envDefault:"8080"`
+	JWTSecret                string         `env:"JWT_SECRET,required"`
+	AWSRegion                string         `env:"AWS_REGION" envDefault:"us-east-1"`
+	AWSAccessKey             string         `env:"AWS_ACCESS_KEY,required"`
+	AWSSecretKey             string         `env:"AWS_SECRET_KEY,required"`
+	DynamodbTableName        string         `env:"DYNAMODB_TABLE_NAME,required"`
+	LotusAPIDialAddr         string         `env:"LOTUS_API_DIAL_ADDR"`
+	LotusAPIToken            string         `env:"LOTUS_API_TOKEN"`
+	LotusAPIDialAddrs        string         `env:"LOTUS_API_DIAL_ADDRS"`
+	LotusAPITokens           string         `env:"LOTUS_API_TOKENS"`
+	LotusMpoolDialAddrs      string         `env:"LOTUS_MPOOL_DIAL_ADDRS"`
+	LotusMpoolTokens         string         `env:"LOTUS_MPOOL_TOKENS"`
+	LotusHealthCheckInterval time.Duration  `env:"LOTUS_HEALTH_CHECK_INTERVAL" envDefault:"15s"`
+	LotusMaxHeadAge          time.Duration  `env:"LOTUS_MAX_HEAD_AGE" envDefault:"2m"`
+	LotusMaxHeightLag        int            `env:"LOTUS_MAX_HEIGHT_LAG" envDefault:"3"`
+	ConfirmationDepth        int            `env:"CONFIRMATION_DEPTH" envDefault:"5"`
+	AllocationIndexSchedule  string         `env:"ALLOCATION_INDEX_SCHEDULE" envDefault:"@every 10m"`
+	NotaryReportSchedule     string         `env:"NOTARY_REPORT_SCHEDULE" envDefault:"@every 6h"`
+	RegistryIndexSchedule    string         `env:"REGISTRY_INDEX_SCHEDULE" envDefault:"@every 1m"`
+	BlockedAddresses         string         `env:"BLOCKED_ADDRESSES"`
+	GithubClientID           string         `env:"GITHUB_CLIENT_ID,required"`
+	GithubClientSecret       string         `env:"GITHUB_CLIENT_SECRET,required"`
+	SentryDsn                string         `env:"SENTRY_DSN"`
+	SentryEnv                string         `env:"SENTRY_ENV"`
+	MaxFee                   types.FIL      `env:"MAX_FEE" envDefault:"0afil"`
+	Mode                     Mode           `env:"MODE"`
+	AdminTokens              string         `env:"ADMIN_TOKENS"`
+	AdminJWTSecret           string         `env:"ADMIN_JWT_SECRET"`
+	AuditSink                AuditSinkKind  `env:"AUDIT_SINK" envDefault:"STDOUT"`
+	AuditFile                string         `env:"AUDIT_FILE"`
+	AuditTableName           string         `env:"AUDIT_TABLE_NAME"`
+	TracesExporter           TracesExporter `env:"OTEL_TRACES_EXPORTER" envDefault:"none"`
+	TracesServiceName        string         `env:"OTEL_SERVICE_NAME" envDefault:"verifier"`
+	AlertWebhookURLs         string         `env:"ALERT_WEBHOOK_URLS"`
+	AlertSchedule            string         `env:"ALERT_SCHEDULE" envDefault:"@every 5m"`
+	AlertRepeatInterval      time.Duration  `env:"ALERT_REPEAT_INTERVAL" envDefault:"6h"`
+	SignerBackend            SignerBackend  `env:"SIGNER_BACKEND" envDefault:"LOCAL"`
+	SignerRPCAddr            string         `env:"SIGNER_RPC_ADDR"`
+	SignerRPCToken           string         `env:"SIGNER_RPC_TOKEN"`
+	SignerRPCNamespace       string         `env:"SIGNER_RPC_NAMESPACE" envDefault:"Filecoin"`
 	// verifier specific env vars
-	VerifierPrivateKey        string          `env:"VERIFIER_PK"`
-	VerifierMinAccountAgeDays uint            `env:"VERIFIER_MIN_ACCOUNT_AGE_DAYS" envDefault:"180"`
-	VerifierRateLimit         time.Duration   `env:"VERIFIER_RATE_LIMIT" envDefault:"730h"`
-	MaxAllowanceBytes         big.Int         `env:"MAX_ALLOWANCE_BYTES"`
-	BaseAllowanceBytes        big.Int         `env:"BASE_ALLOWANCE_BYTES"`
-	MaxTotalAllocations       uint            `env:"MAX_TOTAL_ALLOCATIONS" envDefault:"0"`
-	AllocationsCounterResetPword string       `env:"ALLOCATIONS_COUNTER_PWD"`
-	RedisEndpoint             string          `env:"REDIS_ENDPOINT"`
-	RedisPwd                  string          `env:"REDIS_PASSWORD"`
+	VerifierPrivateKey             string        `env:"VERIFIER_PK"`
+	VerifierAddr                   string        `env:"VERIFIER_ADDR"`
+	VerifierExpectedAddr           string        `env:"VERIFIER_EXPECTED_ADDR"`
+	VerifierMsigAddr               string        `env:"VERIFIER_MSIG_ADDR"`
+	VerifierMsigApproverPrivateKey string        `env:"VERIFIER_MSIG_APPROVER_PK"`
+	VerifierMsigApproverAddr       string        `env:"VERIFIER_MSIG_APPROVER_ADDR"`
+	VerifierMinAccountAgeDays      uint          `env:"VERIFIER_MIN_ACCOUNT_AGE_DAYS" envDefault:"180"`
+	VerifierRateLimit              time.Duration `env:"VERIFIER_RATE_LIMIT" envDefault:"730h"`
+	MaxAllowanceBytes              big.Int       `env:"MAX_ALLOWANCE_BYTES"`
+	BaseAllowanceBytes             big.Int       `env:"BASE_ALLOWANCE_BYTES"`
+	MaxTotalAllocations            uint          `env:"MAX_TOTAL_ALLOCATIONS" envDefault:"0"`
+	AllocationsWindow              CounterWindow `env:"ALLOCATIONS_WINDOW" envDefault:"DAY"`
+	AllocationsRollingWindow       time.Duration `env:"ALLOCATIONS_ROLLING_WINDOW" envDefault:"24h"`
+	MaxWindowAllowanceBytes        big.Int       `env:"MAX_WINDOW_ALLOWANCE_BYTES" envDefault:"0"`
+	VerifierReserveBytes           big.Int       `env:"VERIFIER_RESERVE_BYTES" envDefault:"0"`
+	VerifierLowDataCapBytes        big.Int       `env:"VERIFIER_LOW_DATACAP_BYTES" envDefault:"0"`
+	RedisEndpoint                  string        `env:"REDIS_ENDPOINT"`
+	RedisPwd                       string        `env:"REDIS_PASSWORD"`
 	// faucet specific env vars
-	FaucetPrivateKey          string          `env:"FAUCET_PK"`
-	FaucetRateLimit           time.Duration   `env:"FAUCET_RATE_LIMIT" envDefault:"24h"`
-	FaucetGrantSize           types.FIL       `env:"FAUCET_GRANT_SIZE" envDefault:"10fil"`
-	FaucetMinAccountAgeDays   uint            `env:"FAUCET_MIN_ACCOUNT_AGE" envDefault:"180"`
+	FaucetPrivateKey        string        `env:"FAUCET_PK"`
+	FaucetAddr              string        `env:"FAUCET_ADDR"`
+	FaucetExpectedAddr      string        `env:"FAUCET_EXPECTED_ADDR"`
+	FaucetRateLimit         time.Duration `env:"FAUCET_RATE_LIMIT" envDefault:"24h"`
+	FaucetGrantSize         types.FIL     `env:"FAUCET_GRANT_SIZE" envDefault:"10fil"`
+	FaucetLowBalanceFIL     types.FIL     `env:"FAUCET_LOW_BALANCE_FIL" envDefault:"0fil"`
+	TreasuryPrivateKey      string        `env:"TREASURY_PK"`
+	TreasuryAddr            string        `env:"TREASURY_ADDR"`
+	FaucetRefillLowFIL      types.FIL     `env:"FAUCET_REFILL_LOW_FIL" envDefault:"100fil"`
+	FaucetRefillHighFIL     types.FIL     `env:"FAUCET_REFILL_HIGH_FIL" envDefault:"1000fil"`
+	FaucetRefillSchedule    string        `env:"FAUCET_REFILL_SCHEDULE" envDefault:"@every 10m"`
+	FaucetRefillTimeout     time.Duration `env:"FAUCET_REFILL_TIMEOUT" envDefault:"1h"`
+	FaucetMinAccountAgeDays uint          `env:"FAUCET_MIN_ACCOUNT_AGE" envDefault:"180"`
+	FaucetMaxWindowFIL      types.FIL     `env:"FAUCET_MAX_WINDOW_FIL" envDefault:"0fil"`
+	FaucetMinerRecipient    string        `env:"FAUCET_MINER_RECIPIENT" envDefault:"worker"`
+	FaucetMinerMaxGrants    int           `env:"FAUCET_MINER_MAX_GRANTS" envDefault:"1"`
+	FaucetMinerLimitWindow  time.Duration `env:"FAUCET_MINER_LIMIT_WINDOW" envDefault:"720h"`
+	FaucetMinerChallengeTTL time.Duration `env:"FAUCET_MINER_CHALLENGE_TTL" envDefault:"30m"`
 }
 
 var env Env
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/pkg/errors"
+)
+
+// fakeDynamo holds in-memory tables keyed by ID. It understands the condition, filter and update expressions
+// this package builds with guregu/dynamo: comparisons, IN, AND/OR/NOT, attribute_exists, attribute_not_exists,
+// begins_with, SET and REMOVE.
+type fakeDynamo struct {
+	dynamodbiface.DynamoDBAPI
+
+	lk     sync.Mutex
+	tables map[string]map[string]map[string]*dynamodb.AttributeValue
+}
+
+func newFakeDynamo() *fakeDynamo {
+	return &fakeDynamo{tables: map[string]map[string]map[string]*dynamodb.AttributeValue{}}
+}
+
+// table returns the items of a table, creating it on first use, the caller holds d.lk
+func (d *fakeDynamo) table(name *string) map[string]map[string]*dynamodb.AttributeValue {
+	items, ok := d.tables[aws.StringValue(name)]
+	if !ok {
+		items = map[string]map[string]*dynamodb.AttributeValue{}
+		d.tables[aws.StringValue(name)] = items
+	}
+	return items
+}
+
+var errFakeConditionFailed = awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+
+func (d *fakeDynamo) GetItemWithContext(ctx aws.Context, in *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	items := d.table(in.TableName)
+	item, ok := items[aws.StringValue(in.Key["ID"].S)]
+	if !ok {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	return &dynamodb.GetItemOutput{Item: copyItem(item)}, nil
+}
+
+func (d *fakeDynamo) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	items := d.table(in.TableName)
+	id := aws.StringValue(in.Item["ID"].S)
+	ok, err := d.check(items[id], in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	if err != nil || !ok {
+		return nil, firstErr(err, errFakeConditionFailed)
+	}
+	items[id] = copyItem(in.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (d *fakeDynamo) UpdateItemWithContext(ctx aws.Context, in *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	items := d.table(in.TableName)
+	id := aws.StringValue(in.Key["ID"].S)
+	ok, err := d.check(items[id], in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	if err != nil || !ok {
+		return nil, firstErr(err, errFakeConditionFailed)
+	}
+
+	// an update creates the item when it is missing, like DynamoDB does
+	item := copyItem(items[id])
+	if item == nil {
+		item = copyItem(in.Key)
+	}
+	if err := applyUpdate(item, aws.StringValue(in.UpdateExpression), in.ExpressionAttributeNames, in.ExpressionAttributeValues); err != nil {
+		return nil, err
+	}
+	items[id] = item
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (d *fakeDynamo) DeleteItemWithContext(ctx aws.Context, in *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	items := d.table(in.TableName)
+	id := aws.StringValue(in.Key["ID"].S)
+	ok, err := d.check(items[id], in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	if err != nil || !ok {
+		return nil, firstErr(err, errFakeConditionFailed)
+	}
+	delete(items, id)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// ScanWithContext goes through the items in ID order. Like DynamoDB, Limit caps how many items a page
+// evaluates before filtering, and the next page starts after LastEvaluatedKey.
+func (d *fakeDynamo) ScanWithContext(ctx aws.Context, in *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	items := d.table(in.TableName)
+	ids := make([]string, 0, len(items))
+	for id := range items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if start, ok := in.ExclusiveStartKey["ID"]; ok {
+		ids = ids[sort.SearchStrings(ids, aws.StringValue(start.S)+"\x00"):]
+	}
+
+	out := &dynamodb.ScanOutput{}
+	scanned := int64(0)
+	for _, id := range ids {
+		if in.Limit != nil && scanned == *in.Limit {
+			out.LastEvaluatedKey = map[string]*dynamodb.AttributeValue{"ID": {S: aws.String(ids[scanned-1])}}
+			break
+		}
+		scanned++
+		ok, err := d.check(items[id], in.FilterExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out.Items = append(out.Items, copyItem(items[id]))
+		}
+	}
+	out.Count = aws.Int64(int64(len(out.Items)))
+	out.ScannedCount = aws.Int64(scanned)
+	return out, nil
+}
+
+func (d *fakeDynamo) check(item map[string]*dynamodb.AttributeValue, expr *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (bool, error) {
+	if aws.StringValue(expr) == "" {
+		return true, nil
+	}
+	p, err := newExprParser(*expr, names, values)
+	if err != nil {
+		return false, err
+	}
+	ok, err := p.condition(item)
+	if err == nil && p.pos < len(p.toks) {
+		err = errors.Errorf("unexpected %q in %q", p.toks[p.pos], *expr)
+	}
+	return ok, err
+}
+
+func firstErr(err, otherwise error) error {
+	if err != nil {
+		return err
+	}
+	return otherwise
+}
+
+func copyItem(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	if item == nil {
+		return nil
+	}
+	out := make(map[string]*dynamodb.AttributeValue, len(item))
+	for k, v := range item {
+		out[k] = copyValue(v)
+	}
+	return out
+}
+
+func copyValue(v *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if v == nil {
+		return nil
+	}
+	out := *v
+	out.M = copyItem(v.M)
+	if v.L != nil {
+		out.L = make([]*dynamodb.AttributeValue, len(v.L))
+		for i, e := range v.L {
+			out.L[i] = copyValue(e)
+		}
+	}
+	return &out
+}
+
+// exprParser evaluates one expression against an item, it works on tokens: names, :values, operators,
+// parentheses and commas
+type exprParser struct {
+	toks   []string
+	pos    int
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+}
+
+func newExprParser(expr string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (*exprParser, error) {
+	var toks []string
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("(),", c):
+			toks = append(toks, string(c))
+			i++
+		case c == '<' || c == '>' || c == '=':
+			j := i + 1
+			if j < len(expr) && (expr[j] == '=' || expr[j] == '>') && c != '=' {
+				j++
+			}
+			toks = append(toks, expr[i:j])
+			i = j
+		default:
+			j := i
+			for j < len(expr) && (unicode.IsLetter(rune(expr[j])) || unicode.IsDigit(rune(expr[j])) || strings.ContainsRune("_.#:-", rune(expr[j]))) {
+				j++
+			}
+			if j == i {
+				return nil, errors.Errorf("unexpected %q in %q", c, expr)
+			}
+			toks = append(toks, expr[i:j])
+			i = j
+		}
+	}
+	return &exprParser{toks: toks, names: names, values: values}, nil
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *exprParser) expect(tok string) error {
+	if got := p.next(); got != tok {
+		return errors.Errorf("expected %q, got %q", tok, got)
+	}
+	return nil
+}
+
+func (p *exprParser) condition(item map[string]*dynamodb.AttributeValue) (bool, error) {
+	ok, err := p.and(item)
+	for err == nil && strings.EqualFold(p.peek(), "OR") {
+		p.next()
+		var right bool
+		right, err = p.and(item)
+		ok = ok || right
+	}
+	return ok, err
+}
+
+func (p *exprParser) and(item map[string]*dynamodb.AttributeValue) (bool, error) {
+	ok, err := p.not(item)
+	for err == nil && strings.EqualFold(p.peek(), "AND") {
+		p.next()
+		var right bool
+		right, err = p.not(item)
+		ok = ok && right
+	}
+	return ok, err
+}
+
+func (p *exprParser) not(item map[string]*dynamodb.AttributeValue) (bool, error) {
+	if strings.EqualFold(p.peek(), "NOT") {
+		p.next()
+		ok, err := p.not(item)
+		return !ok, err
+	}
+	return p.primary(item)
+}
+
+func (p *exprParser) primary(item map[string]*dynamodb.AttributeValue) (bool, error) {
+	if p.peek() == "(" {
+		p.next()
+		ok, err := p.condition(item)
+		if err != nil {
+			return false, err
+		}
+		return ok, p.expect(")")
+	}
+
+	switch fn := p.peek(); fn {
+	case "attribute_exists", "attribute_not_exists", "begins_with":
+		p.next()
+		if err := p.expect("("); err != nil {
+			return false, err
+		}
+		v, err := p.operand(item)
+		if err != nil {
+			return false, err
+		}
+		var ok bool
+		switch fn {
+		case "attribute_exists":
+			ok = v != nil
+		case "attribute_not_exists":
+			ok = v == nil
+		default:
+			if err := p.expect(","); err != nil {
+				return false, err
+			}
+			prefix, err := p.operand(item)
+			if err != nil {
+				return false, err
+			}
+			ok = v != nil && prefix != nil && v.S != nil && prefix.S != nil && strings.HasPrefix(*v.S, *prefix.S)
+		}
+		return ok, p.expect(")")
+	}
+
+	left, err := p.operand(item)
+	if err != nil {
+		return false, err
+	}
+	op := p.next()
+	if strings.EqualFold(op, "IN") {
+		if err := p.expect("("); err != nil {
+			return false, err
+		}
+		found := false
+		for {
+			v, err := p.operand(item)
+			if err != nil {
+				return false, err
+			}
+			if c, ok := compareValues(left, v); ok && c == 0 {
+				found = true
+			}
+			if p.peek() != "," {
+				break
+			}
+			p.next()
+		}
+		return found, p.expect(")")
+	}
+
+	right, err := p.operand(item)
+	if err != nil {
+		return false, err
+	}
+	c, comparable := compareValues(left, right)
+	switch op {
+	case "=":
+		return comparable && c == 0, nil
+	case "<>":
+		return !comparable || c != 0, nil
+	case "<":
+		return comparable && c < 0, nil
+	case "<=":
+		return comparable && c <= 0, nil
+	case ">":
+		return comparable && c > 0, nil
+	case ">=":
+		return comparable && c >= 0, nil
+	}
+	return false, errors.Errorf("unknown operator %q", op)
+}
+
+// operand is a :value or the value at a path of the item, nil when the item doesn't have it
+func (p *exprParser) operand(item map[string]*dynamodb.AttributeValue) (*dynamodb.AttributeValue, error) {
+	tok := p.next()
+	if strings.HasPrefix(tok, ":") {
+		v, ok := p.values[tok]
+		if !ok {
+			return nil, errors.Errorf("no value for %s", tok)
+		}
+		return v, nil
+	}
+	path, err := p.path(tok)
+	if err != nil {
+		return nil, err
+	}
+	v := &dynamodb.AttributeValue{M: item}
+	for _, name := range path {
+		if v == nil || v.M == nil {
+			return nil, nil
+		}
+		v = v.M[name]
+	}
+	return v, nil
+}
+
+// path splits a document path and substitutes its #names
+func (p *exprParser) path(tok string) ([]string, error) {
+	if tok == "" {
+		return nil, errors.New("expected a name")
+	}
+	parts := strings.Split(tok, ".")
+	for i, part := range parts {
+		if strings.HasPrefix(part, "#") {
+			name, ok := p.names[part]
+			if !ok {
+				return nil, errors.Errorf("no name for %s", part)
+			}
+			parts[i] = *name
+		}
+	}
+	return parts, nil
+}
+
+// compareValues orders two strings, numbers or booleans, the second result is false when they can't be compared
+func compareValues(a, b *dynamodb.AttributeValue) (int, bool) {
+	switch {
+	case a == nil || b == nil:
+		return 0, false
+	case a.S != nil && b.S != nil:
+		return strings.Compare(*a.S, *b.S), true
+	case a.N != nil && b.N != nil:
+		x, okx := new(big.Rat).SetString(*a.N)
+		y, oky := new(big.Rat).SetString(*b.N)
+		if !okx || !oky {
+			return 0, false
+		}
+		return x.Cmp(y), true
+	case a.BOOL != nil && b.BOOL != nil:
+		if *a.BOOL == *b.BOOL {
+			return 0, true
+		}
+		return 1, true
+	case a.NULL != nil && b.NULL != nil:
+		return 0, true
+	}
+	return 0, false
+}
+
+// applyUpdate runs the SET and REMOVE clauses of an update expression on item
+func applyUpdate(item map[string]*dynamodb.AttributeValue, expr string, names map[string]*string, values map[string]*dynamodb.AttributeValue) error {
+	p, err := newExprParser(expr, names, values)
+	if err != nil {
+		return err
+	}
+	for p.pos < len(p.toks) {
+		clause := strings.ToUpper(p.next())
+		for {
+			path, err := p.path(p.next())
+			if err != nil {
+				return err
+			}
+			switch clause {
+			case "SET":
+				if err := p.expect("="); err != nil {
+					return err
+				}
+				v, err := p.operand(item)
+				if err != nil {
+					return err
+				}
+				setPath(item, path, copyValue(v))
+			case "REMOVE":
+				setPath(item, path, nil)
+			default:
+				return errors.Errorf("unsupported update clause %q in %q", clause, expr)
+			}
+			if p.peek() != "," {
+				break
+			}
+			p.next()
+		}
+	}
+	return nil
+}
+
+// setPath sets or, with a nil v, removes the value at path
+func setPath(item map[string]*dynamodb.AttributeValue, path []string, v *dynamodb.AttributeValue) {
+	for _, name := range path[:len(path)-1] {
+		next, ok := item[name]
+		if !ok || next.M == nil {
+			if v == nil {
+				return
+			}
+			next = &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{}}
+			item[name] = next
+		}
+		item = next.M
+	}
+	last := path[len(path)-1]
+	if v == nil {
+		delete(item, last)
+	} else {
+		item[last] = v
+	}
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	verifregtypes "github.com/filecoin-project/go-state-types/builtin/v9/verifreg"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/filecoin-project/go-state-types/network"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/actors"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/filecoin-project/specs-actors/actors/builtin/multisig"
+	"github.com/filecoin-project/specs-actors/actors/builtin/verifreg"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
+)
+
+var (
+	// fakeSenderBalance is what our own addresses start with on the fake node
+	fakeSenderBalance = big.Mul(big.NewInt(10000), big.NewInt(1e18))
+	// fakeNotaryDataCap is what our notary starts with on the fake node, 1 PiB
+	fakeNotaryDataCap = big.Lsh(big.NewInt(1), 50)
+)
+
+// fakeStartHeight leaves room for lookbacks like lotusGetYesterdayTipsetKey
+const fakeStartHeight abi.ChainEpoch = 10000
+
+var fakeMinerAddr, _ = address.NewIDAddress(1000)
+
+// fakeNode is an in-process lotusAPI for the tests, with a mempool, a chain the test mines, value transfers,
+// AddVerifiedClient and multisig proposals. It has no real actor state: ChainReadObj only returns what
+// was put with ChainPutObj.
+type fakeNode struct {
+	lk sync.Mutex
+
+	height   abi.ChainEpoch
+	epochs   map[abi.ChainEpoch]fakeEpoch
+	forks    int
+	stalled  bool
+	pushErr  error
+	failures map[address.Address]exitcode.ExitCode
+	balErrs  map[address.Address]error
+
+	nonces    map[address.Address]uint64
+	balances  map[address.Address]big.Int
+	verifiers map[address.Address]big.Int
+	clients   map[address.Address]big.Int
+	miners    map[address.Address]fakeMiner
+	txnID     int64
+
+	mpool    []*types.SignedMessage
+	included map[cid.Cid]*fakeInclusion
+	order    []cid.Cid
+	objects  map[cid.Cid][]byte
+}
+
+// fakeMiner is a storage miner registered through the admin routes, its keys are used as they are
+type fakeMiner struct {
+	owner  address.Address
+	worker address.Address
+}
+
+type fakeEpoch struct {
+	timestamp uint64
+	fork      int
+}
+
+type fakeInclusion struct {
+	msg     *types.SignedMessage
+	height  abi.ChainEpoch
+	receipt types.MessageReceipt
+	undo    fakeJournal
+}
+
+// fakeJournal records how to undo the state changes of a message, so a reorg can revert it
+type fakeJournal []func()
+
+func (j fakeJournal) revert() {
+	for i := len(j) - 1; i >= 0; i-- {
+		j[i]()
+	}
+}
+
+// newFakeNode starts a fake chain, blocks are only mined by calling mine
+func newFakeNode() *fakeNode {
+	n := &fakeNode{
+		height:    fakeStartHeight,
+		epochs:    map[abi.ChainEpoch]fakeEpoch{},
+		failures:  map[address.Address]exitcode.ExitCode{},
+		balErrs:   map[address.Address]error{},
+		nonces:    map[address.Address]uint64{},
+		balances:  map[address.Address]big.Int{},
+		verifiers: map[address.Address]big.Int{},
+		clients:   map[address.Address]big.Int{},
+		miners:    map[address.Address]fakeMiner{},
+		included:  map[cid.Cid]*fakeInclusion{},
+		objects:   map[cid.Cid][]byte{},
+	}
+	n.epochs[n.height] = fakeEpoch{timestamp: uint64(time.Now().Unix())}
+	return n
+}
+
+// mine includes everything in the mempool in a new block
+func (n *fakeNode) mine() {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if n.stalled {
+		return
+	}
+
+	n.height++
+	n.epochs[n.height] = fakeEpoch{timestamp: uint64(time.Now().Unix()), fork: n.forks}
+	for _, smsg := range n.mpool {
+		var j fakeJournal
+		code, ret := n.apply(&smsg.Message, &j)
+		c := smsg.Cid()
+		n.included[c] = &fakeInclusion{
+			msg:     smsg,
+			height:  n.height,
+			receipt: types.MessageReceipt{ExitCode: code, Return: ret, GasUsed: smsg.Message.GasLimit / 2},
+			undo:    j,
+		}
+		n.order = append(n.order, c)
+	}
+	n.mpool = nil
+}
+
+// stall stops the chain from advancing, nothing gets included until it is resumed
+func (n *fakeNode) stall(stalled bool) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	n.stalled = stalled
+}
+
+// reorg drops the last depth blocks, their messages go back to the mempool
+func (n *fakeNode) reorg(depth int) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+
+	newHeight := n.height - abi.ChainEpoch(depth)
+	var reverted []*types.SignedMessage
+	for len(n.order) > 0 {
+		c := n.order[len(n.order)-1]
+		inc := n.included[c]
+		if inc.height <= newHeight {
+			break
+		}
+		inc.undo.revert()
+		delete(n.included, c)
+		n.order = n.order[:len(n.order)-1]
+		reverted = append([]*types.SignedMessage{inc.msg}, reverted...)
+	}
+	for h := newHeight + 1; h <= n.height; h++ {
+		delete(n.epochs, h)
+	}
+	n.height = newHeight
+	n.forks++
+	n.mpool = append(reverted, n.mpool...)
+}
+
+// failTo makes every message to addr fail with code, for AddVerifiedClient addr is the client
+func (n *fakeNode) failTo(addr address.Address, code exitcode.ExitCode) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if code.IsSuccess() {
+		delete(n.failures, addr)
+		return
+	}
+	n.failures[addr] = code
+}
+
+// failPush makes MpoolPush return err, nil lets messages in again
+func (n *fakeNode) failPush(err error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	n.pushErr = err
+}
+
+func (n *fakeNode) setBalance(addr address.Address, bal big.Int) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	n.balances[addr] = bal
+}
+
+// failBalance makes WalletBalance of addr fail with err, or succeed again when err is nil
+func (n *fakeNode) failBalance(addr address.Address, err error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if err == nil {
+		delete(n.balErrs, addr)
+		return
+	}
+	n.balErrs[addr] = err
+}
+
+func (n *fakeNode) setVerifierDataCap(addr address.Address, dcap big.Int) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	n.verifiers[addr] = dcap
+}
+
+func (n *fakeNode) setMiner(miner, owner, worker address.Address) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	n.miners[miner] = fakeMiner{owner: owner, worker: worker}
+}
+
+// ownAddr tells the faucet, notary and treasury addresses apart, they start funded
+func ownAddr(addr address.Address) bool {
+	if addr == TreasuryAddr || addr == MsigApproverAddr || addr == VerifierMsigAddr {
+		return true
+	}
+	for _, a := range append(faucetSenders.addrs(), verifierSenders.addrs()...) {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *fakeNode) balance(addr address.Address) big.Int {
+	if bal, ok := n.balances[addr]; ok {
+		return bal
+	}
+	if ownAddr(addr) {
+		return fakeSenderBalance
+	}
+	return big.Zero()
+}
+
+func (n *fakeNode) verifierDataCap(addr address.Address) big.Int {
+	if dcap, ok := n.verifiers[addr]; ok {
+		return dcap
+	}
+	if ownAddr(addr) {
+		return fakeNotaryDataCap
+	}
+	return big.Zero()
+}
+
+func (n *fakeNode) set(m map[address.Address]big.Int, addr address.Address, v big.Int, j *fakeJournal) {
+	prev, had := m[addr]
+	m[addr] = v
+	*j = append(*j, func() {
+		if had {
+			m[addr] = prev
+		} else {
+			delete(m, addr)
+		}
+	})
+}
+
+func (n *fakeNode) transfer(from, to address.Address, value big.Int, j *fakeJournal) exitcode.ExitCode {
+	if value.Int == nil || value.IsZero() {
+		return exitcode.Ok
+	}
+	bal := n.balance(from)
+	if bal.LessThan(value) {
+		return exitcode.SysErrInsufficientFunds
+	}
+	toBal := n.balance(to)
+	n.set(n.balances, from, big.Sub(bal, value), j)
+	n.set(n.balances, to, big.Add(toBal, value), j)
+	return exitcode.Ok
+}
+
+// apply runs msg against the fake state and returns its receipt
+func (n *fakeNode) apply(msg *types.Message, j *fakeJournal) (exitcode.ExitCode, []byte) {
+	return n.applyCall(msg.From, msg.To, msg.Method, msg.Params, msg.Value, j)
+}
+
+func (n *fakeNode) applyCall(from, to address.Address, method abi.MethodNum, params []byte, value big.Int, j *fakeJournal) (exitcode.ExitCode, []byte) {
+	switch {
+	case to == builtin.VerifiedRegistryActorAddr && method == builtin.MethodsVerifiedRegistry.AddVerifiedClient:
+		var p verifreg.AddVerifiedClientParams
+		if err := p.UnmarshalCBOR(bytes.NewReader(params)); err != nil {
+			return exitcode.ErrSerialization, nil
+		}
+		if code, ok := n.failures[p.Address]; ok {
+			return code, nil
+		}
+		dcap := n.verifierDataCap(from)
+		if dcap.LessThan(p.Allowance) {
+			return exitcode.ErrIllegalArgument, nil
+		}
+		n.set(n.verifiers, from, big.Sub(dcap, p.Allowance), j)
+		clientCap, ok := n.clients[p.Address]
+		if !ok {
+			clientCap = big.Zero()
+		}
+		n.set(n.clients, p.Address, big.Add(clientCap, p.Allowance), j)
+		return exitcode.Ok, nil
+
+	case to == VerifierMsigAddr && method == builtin.MethodsMultisig.Propose:
+		// every proposal has enough approvals on the fake node, so it executes right away
+		var p multisig.ProposeParams
+		if err := p.UnmarshalCBOR(bytes.NewReader(params)); err != nil {
+			return exitcode.ErrSerialization, nil
+		}
+		code, innerRet := n.applyCall(to, p.To, p.Method, p.Params, p.Value, j)
+		n.txnID++
+		ret, err := actors.SerializeParams(&multisig.ProposeReturn{
+			TxnID:   multisig.TxnID(n.txnID),
+			Applied: true,
+			Code:    code,
+			Ret:     innerRet,
+		})
+		if err != nil {
+			return exitcode.ErrSerialization, nil
+		}
+		return exitcode.Ok, ret
+
+	default:
+		if code, ok := n.failures[to]; ok {
+			return code, nil
+		}
+		return n.transfer(from, to, value, j), nil
+	}
+}
+
+// fakeCid is a stable CID for data
+func fakeCid(data string) cid.Cid {
+	c, err := abi.CidBuilder.Sum([]byte(data))
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func (n *fakeNode) tipSetAt(h abi.ChainEpoch) (*types.TipSet, error) {
+	epoch, ok := n.epochs[h]
+	if !ok {
+		// before the fake node started, pretend blocks came every 30 seconds
+		start := n.epochs[fakeStartHeight].timestamp
+		epoch = fakeEpoch{timestamp: start - uint64(fakeStartHeight-h)*30}
+	}
+	return types.NewTipSet([]*types.BlockHeader{{
+		Miner:                 fakeMinerAddr,
+		Ticket:                &types.Ticket{VRFProof: []byte(fmt.Sprintf("%d/%d", h, epoch.fork))},
+		Parents:               []cid.Cid{fakeCid(fmt.Sprintf("block/%d", h-1))},
+		ParentWeight:          big.NewInt(int64(h)),
+		Height:                h,
+		ParentStateRoot:       fakeCid(fmt.Sprintf("state/%d", h)),
+		ParentMessageReceipts: fakeCid(fmt.Sprintf("receipts/%d", h)),
+		Messages:              fakeCid(fmt.Sprintf("messages/%d", h)),
+		Timestamp:             epoch.timestamp,
+		ParentBaseFee:         big.NewInt(100),
+	}})
+}
+
+func (n *fakeNode) ChainHead(ctx context.Context) (*types.TipSet, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	return n.tipSetAt(n.height)
+}
+
+func (n *fakeNode) ChainGetTipSetByHeight(ctx context.Context, h abi.ChainEpoch, tsk types.TipSetKey) (*types.TipSet, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if h < 0 || h > n.height {
+		return nil, errors.Errorf("looking for tipset with height greater than start point")
+	}
+	return n.tipSetAt(h)
+}
+
+func (n *fakeNode) ChainGetMessage(ctx context.Context, c cid.Cid) (*types.Message, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if inc, ok := n.included[c]; ok {
+		return &inc.msg.Message, nil
+	}
+	for _, smsg := range n.mpool {
+		if smsg.Cid() == c {
+			return &smsg.Message, nil
+		}
+	}
+	return nil, errors.Errorf("message %v not found", c)
+}
+
+func (n *fakeNode) ChainReadObj(ctx context.Context, c cid.Cid) ([]byte, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if b, ok := n.objects[c]; ok {
+		return b, nil
+	}
+	return nil, errors.Errorf("blockstore: block not found: %v", c)
+}
+
+func (n *fakeNode) ChainHasObj(ctx context.Context, c cid.Cid) (bool, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	_, ok := n.objects[c]
+	return ok, nil
+}
+
+func (n *fakeNode) ChainPutObj(ctx context.Context, blk blocks.Block) error {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	n.objects[blk.Cid()] = blk.RawData()
+	return nil
+}
+
+func (n *fakeNode) MpoolGetNonce(ctx context.Context, addr address.Address) (uint64, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	return n.nonces[addr], nil
+}
+
+func (n *fakeNode) MpoolPush(ctx context.Context, smsg *types.SignedMessage) (cid.Cid, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if n.pushErr != nil {
+		return cid.Undef, n.pushErr
+	}
+
+	msg := smsg.Message
+	if msg.Nonce < n.nonces[msg.From] {
+		return cid.Undef, errors.Errorf("minimum expected nonce is %d: nonce too low", n.nonces[msg.From])
+	}
+	if msg.Value.Int != nil && n.balance(msg.From).LessThan(msg.Value) {
+		return cid.Undef, errors.Errorf("not enough funds including pending messages")
+	}
+	n.nonces[msg.From] = msg.Nonce + 1
+	n.mpool = append(n.mpool, smsg)
+	return smsg.Cid(), nil
+}
+
+func (n *fakeNode) GasEstimateMessageGas(ctx context.Context, msg *types.Message, spec *api.MessageSendSpec, tsk types.TipSetKey) (*types.Message, error) {
+	out := *msg
+	out.GasLimit = 1000000
+	out.GasFeeCap = big.NewInt(100000)
+	out.GasPremium = big.NewInt(1000)
+	if out.Value.Int == nil {
+		out.Value = big.Zero()
+	}
+	return &out, nil
+}
+
+func (n *fakeNode) StateGetActor(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*types.Actor, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	act := &types.Actor{
+		Head:    fakeCid("actor/" + addr.String()),
+		Nonce:   n.nonces[addr],
+		Balance: n.balance(addr),
+	}
+	if _, ok := n.miners[addr]; ok {
+		act.Code = builtin.StorageMinerActorCodeID
+	}
+	return act, nil
+}
+
+func (n *fakeNode) StateSearchMsg(ctx context.Context, c cid.Cid) (*api.MsgLookup, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	inc, ok := n.included[c]
+	if !ok {
+		return nil, nil
+	}
+	ts, err := n.tipSetAt(inc.height)
+	if err != nil {
+		return nil, err
+	}
+	return &api.MsgLookup{
+		Message: c,
+		Receipt: inc.receipt,
+		TipSet:  ts.Key(),
+		Height:  inc.height,
+	}, nil
+}
+
+// StateListMessages lists the included messages matching match, newest first like lotus
+func (n *fakeNode) StateListMessages(ctx context.Context, match *api.MessageMatch, tsk types.TipSetKey, toht abi.ChainEpoch) ([]cid.Cid, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	var out []cid.Cid
+	for i := len(n.order) - 1; i >= 0; i-- {
+		inc := n.included[n.order[i]]
+		if inc.height < toht {
+			break
+		}
+		if (match.To == address.Undef || match.To == inc.msg.Message.To) && (match.From == address.Undef || match.From == inc.msg.Message.From) {
+			out = append(out, n.order[i])
+		}
+	}
+	return out, nil
+}
+
+func (n *fakeNode) StateVerifierStatus(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*abi.StoragePower, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	dcap := n.verifierDataCap(addr)
+	if dcap.IsZero() {
+		return nil, nil
+	}
+	return &dcap, nil
+}
+
+func (n *fakeNode) StateVerifiedClientStatus(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*abi.StoragePower, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	dcap, ok := n.clients[addr]
+	if !ok {
+		return nil, nil
+	}
+	return &dcap, nil
+}
+
+func (n *fakeNode) StateListMiners(ctx context.Context, tsk types.TipSetKey) ([]address.Address, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	miners := []address.Address{fakeMinerAddr}
+	for addr := range n.miners {
+		miners = append(miners, addr)
+	}
+	return miners, nil
+}
+
+func (n *fakeNode) StateMinerInfo(ctx context.Context, actor address.Address, tsk types.TipSetKey) (api.MinerInfo, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	m, ok := n.miners[actor]
+	if !ok {
+		return api.MinerInfo{}, errors.Errorf("actor not found: %v", actor)
+	}
+	return api.MinerInfo{Owner: m.owner, Worker: m.worker}, nil
+}
+
+// StateAccountKey returns the address as it is, fake miners are registered with their key addresses
+func (n *fakeNode) StateAccountKey(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
+	return addr, nil
+}
+
+// StateNetworkVersion is the version the fake node pretends to run, its state is always in the datacap era
+func (n *fakeNode) StateNetworkVersion(ctx context.Context, tsk types.TipSetKey) (network.Version, error) {
+	return network.Version18, nil
+}
+
+// StateLookupID treats every address as its own ID, the fake node keeps no address table
+func (n *fakeNode) StateLookupID(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
+	return addr, nil
+}
+
+// StateMarketDeals is empty, the fake node has no storage market
+func (n *fakeNode) StateMarketDeals(ctx context.Context, tsk types.TipSetKey) (map[string]*api.MarketDeal, error) {
+	return map[string]*api.MarketDeal{}, nil
+}
+
+// StateGetAllocations is empty, fake clients never allocate their datacap
+func (n *fakeNode) StateGetAllocations(ctx context.Context, clientAddr address.Address, tsk types.TipSetKey) (map[verifregtypes.AllocationId]verifregtypes.Allocation, error) {
+	return map[verifregtypes.AllocationId]verifregtypes.Allocation{}, nil
+}
+
+func (n *fakeNode) StateGetClaims(ctx context.Context, providerAddr address.Address, tsk types.TipSetKey) (map[verifregtypes.ClaimId]verifregtypes.Claim, error) {
+	return map[verifregtypes.ClaimId]verifregtypes.Claim{}, nil
+}
+
+func (n *fakeNode) MsigGetPending(ctx context.Context, addr address.Address, tsk types.TipSetKey) ([]*api.MsigTransaction, error) {
+	// proposals execute as soon as they land
+	return nil, nil
+}
+
+func (n *fakeNode) WalletBalance(ctx context.Context, addr address.Address) (types.BigInt, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if err := n.balErrs[addr]; err != nil {
+		return types.BigInt{}, err
+	}
+	return n.balance(addr), nil
+}
+
+func (n *fakeNode) WalletHas(ctx context.Context, addr address.Address) (bool, error) {
+	return true, nil
+}
+
+// WalletSign backs the LOTUS signer, the fake node doesn't check signatures
+func (n *fakeNode) WalletSign(ctx context.Context, addr address.Address, msg []byte) (*crypto.Signature, error) {
+	return &crypto.Signature{Type: crypto.SigTypeSecp256k1, Data: make([]byte, 65)}, nil
+}
@@ -3,6 +3,7 @@ module github.com/openworklabs/oauthserver
 go 1.14
 
 require (
+	github.com/alicebob/miniredis/v2 v2.23.0
 	github.com/aws/aws-sdk-go v1.40.45
 	github.com/caarlos0/env v3.5.0+incompatible
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
@@ -11,17 +12,27 @@ require (
 	github.com/filecoin-project/go-state-types v0.10.0-rc3
 	github.com/filecoin-project/lotus v1.20.0-rc2
 	github.com/filecoin-project/specs-actors v0.9.15
+	github.com/getsentry/sentry-go v0.12.0
 	github.com/gin-contrib/cors v1.3.1
-	github.com/gin-gonic/gin v1.6.3
+	github.com/gin-gonic/gin v1.8.1
 	github.com/glifio/go-logger v0.7.0
-	github.com/go-redis/redis/v8 v8.11.4
+	github.com/go-redis/redis/extra/redisotel/v8 v8.11.5
+	github.com/go-redis/redis/v8 v8.11.5
 	github.com/google/uuid v1.3.0
 	github.com/guregu/dynamo v1.10.2
+	github.com/ipfs/go-block-format v0.1.1
 	github.com/ipfs/go-cid v0.3.2
-	github.com/ipfs/go-hamt-ipld v0.1.1
+	github.com/ipfs/go-hamt-ipld v0.1.1 // indirect
 	github.com/ipfs/go-ipld-cbor v0.0.6
 	github.com/pkg/errors v0.9.1
-	github.com/whyrusleeping/cbor-gen v0.0.0-20221021053955-c138aae13722
+	github.com/prometheus/client_golang v1.13.0
+	github.com/whyrusleeping/cbor-gen v0.0.0-20221021053955-c138aae13722 // indirect
+	go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin v0.36.4
+	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.36.4
+	go.opentelemetry.io/otel v1.11.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.11.1
+	go.opentelemetry.io/otel/sdk v1.11.1
+	go.opentelemetry.io/otel/trace v1.11.1
 	gopkg.in/robfig/cron.v2 v2.0.0-20150107220207-be2e0b0deed5
 )
 
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+)
+
+// readyzTimeout bounds each dependency check of /readyz
+const readyzTimeout = 5 * time.Second
+
+// readyzProbeID is read from DynamoDB to check it answers, it doesn't exist so the read is cheap
+const readyzProbeID = "READYZ#probe"
+
+// DependencyStatus is the state of one dependency on /readyz
+type DependencyStatus struct {
+	OK        bool        `json:"ok"`
+	LatencyMs int64       `json:"latencyMs"`
+	Error     string      `json:"error,omitempty"`
+	Details   interface{} `json:"details,omitempty"`
+}
+
+// dependencyCheck checks one dependency, details are shown on /readyz whether it passes or not
+type dependencyCheck func(ctx context.Context) (details interface{}, err error)
+
+func readinessChecks() map[string]dependencyCheck {
+	checks := map[string]dependencyCheck{
+		"lotus":  checkLotusReady,
+		"dynamo": checkDynamoReady,
+		"signer": checkSignerReady,
+	}
+	if redisEnabled() {
+		checks["redis"] = checkRedisReady
+	}
+	return checks
+}
+
+// checkLotusReady uses the result of the last background health check, so a probe doesn't hit every node
+func checkLotusReady(ctx context.Context) (interface{}, error) {
+	endpoints := lotusClient.status()
+	if !lotusClient.healthy() {
+		return endpoints, errors.New("no healthy Lotus endpoint for reads and pushes")
+	}
+	return endpoints, nil
+}
+
+func checkDynamoReady(ctx context.Context) (interface{}, error) {
+	var user User
+	err := dynamoTable(env.DynamodbTableName).Get("ID", readyzProbeID).OneWithContext(ctx, &user)
+	if err == dynamo.ErrNotFound {
+		err = nil
+	}
+	return nil, err
+}
+
+// checkRedisReady pings through the shared client, its pool stats show whether connections are reused
+func checkRedisReady(ctx context.Context) (interface{}, error) {
+	rdb := getRedis()
+	err := rdb.Ping(ctx).Err()
+	return rdb.PoolStats(), err
+}
+
+func checkSignerReady(ctx context.Context) (interface{}, error) {
+	return env.SignerBackend, signers.check(ctx)
+}
+
+// serveLivez only shows the process still answers requests
+func serveLivez(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// serveReadyz checks every dependency in parallel, and answers 503 when any of them is down
+func serveReadyz(c *gin.Context) {
+	checks := readinessChecks()
+
+	var lk sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]DependencyStatus, len(checks))
+	ready := true
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check dependencyCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(c.Request.Context(), readyzTimeout)
+			defer cancel()
+
+			start := time.Now()
+			details, err := check(ctx)
+			st := DependencyStatus{OK: err == nil, LatencyMs: time.Since(start).Milliseconds(), Details: details}
+			if err != nil {
+				st.Error = err.Error()
+			}
+
+			lk.Lock()
+			defer lk.Unlock()
+			results[name] = st
+			ready = ready && st.OK
+		}(name, check)
+	}
+	wg.Wait()
+
+	status, code := "ok", http.StatusOK
+	if !ready {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	c.JSON(code, gin.H{"status": status, "dependencies": results})
+}
+
+// serveHealthz reports the health of each Lotus endpoint, it always answers 200 so a bad node doesn't
+// restart the pod
+func serveHealthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"lotus": gin.H{
+			"healthy":   lotusClient.healthy(),
+			"endpoints": lotusClient.status(),
+		},
+	})
+}
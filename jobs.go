@@ -2,14 +2,16 @@ package main
 
 import (
 	"context"
-	"time"
 
 	"github.com/glifio/go-logger"
 	"github.com/ipfs/go-cid"
 )
 
 func reconcileVerifierMessages() {
-	users, err := getLockedUsers(UserLock_Verifier)
+	ctx, span := tracer.Start(context.Background(), "reconcileVerifierMessages")
+	defer span.End()
+
+	users, err := getLockedUsers(ctx, UserLock_Verifier)
 	if err != nil {
 		logger.Errorf("ERROR GETTING LOCKED USERS: %v", err)
 		return
@@ -21,31 +23,66 @@ func reconcileVerifierMessages() {
 			logger.Errorf("ERROR DECODING DATACAP CID: %v", err)
 			continue
 		}
-		mLookup, err := lotusSearchMessageResult(context.TODO(), cid)
+		inc, err := followGrantMessage(ctx, VerifierMode, user.ID, cid)
 		if err != nil {
 			logger.Errorf("ERROR SEARCHING LOTUS MESSAGE: %v", err)
+			reconciled(VerifierMode, outcomeError)
+			continue
+		}
+		if inc == nil {
 			continue
 		}
 
-		finished := mLookup != nil
-		confirmed := mLookup.Receipt.ExitCode.IsSuccess()
-		if finished && confirmed {
-			user.MostRecentAllocation = time.Now()
+		confirmed := inc.Receipt.ExitCode.IsSuccess()
+		if confirmed && msigEnabled() {
+			// the proposal landed, follow it until the multisig executes it
+			state, err := reconcileMsigProposal(ctx, &user, inc)
+			if state == msigFailed {
+				logger.Errorf("MULTISIG PROPOSAL FAILED: User ID %q, Cid %q: %v", user.ID, cid, err)
+				reconciled(VerifierMode, outcomeFailed)
+				if err := setGrantStatus(ctx, cid.String(), GrantFailed); err != nil {
+					logger.Errorf("ERROR SAVING GRANT: %v", err)
+				}
+				continue
+			}
+			if err != nil {
+				logger.Errorf("ERROR RECONCILING MULTISIG PROPOSAL: %v", err)
+				reconciled(VerifierMode, outcomeError)
+				continue
+			}
+			if state == msigPending {
+				reconciled(VerifierMode, outcomePending)
+				continue
+			}
+		}
+		if confirmed {
+			user.MostRecentAllocation = inc.Timestamp
 			user.Locked_Verifier = false
-			err = saveUser(user)
+			err = saveUser(ctx, user)
 			if err != nil {
 				logger.Errorf("ERROR SAVING USER: %v", err)
 				continue
 			}
-		} else if finished {
-			logger.Errorf("TRANSACTION FAILED: %v", mLookup.Receipt.ExitCode.Error())
-			continue
+			if err := setGrantStatus(ctx, cid.String(), GrantConfirmed); err != nil {
+				logger.Errorf("ERROR SAVING GRANT: %v", err)
+			}
+			reconciled(VerifierMode, outcomeConfirmed)
+		} else {
+			// the user stays locked until an admin unlocks, fails or re-drives the grant
+			logger.Errorf("TRANSACTION FAILED: User ID %q, Cid %q: %v", user.ID, cid, inc.Receipt.ExitCode.Error())
+			reconciled(VerifierMode, outcomeFailed)
+			if err := setGrantStatus(ctx, cid.String(), GrantFailed); err != nil {
+				logger.Errorf("ERROR SAVING GRANT: %v", err)
+			}
 		}
 	}
 }
 
 func reconcileFaucetMessages() {
-	users, err := getLockedUsers(UserLock_Faucet)
+	ctx, span := tracer.Start(context.Background(), "reconcileFaucetMessages")
+	defer span.End()
+
+	users, err := getLockedUsers(ctx, UserLock_Faucet)
 	if err != nil {
 		logger.Errorf("ERROR GETTING LOCKED USERS: %v", err)
 		return
@@ -55,27 +92,76 @@ func reconcileFaucetMessages() {
 		cid, err := cid.Decode(user.MostRecentFaucetGrantCid)
 		if err != nil {
 			logger.Errorf("ERROR DECODING FAUCET GRANT CID: %v", err)
-			return
+			continue
 		}
-		mLookup, err := lotusSearchMessageResult(context.TODO(), cid)
+		inc, err := followGrantMessage(ctx, FaucetMode, user.ID, cid)
 		if err != nil {
 			logger.Errorf("ERROR SEARCHING LOTUS MESSAGE: %v", err)
-			return
+			reconciled(FaucetMode, outcomeError)
+			continue
+		}
+		if inc == nil {
+			continue
 		}
 
-		finished := mLookup != nil
-		confirmed := mLookup.Receipt.ExitCode.IsSuccess()
-		if finished && confirmed {
+		if inc.Receipt.ExitCode.IsSuccess() {
 			user.ReceivedFaucetGrant = true
 			user.Locked_Faucet = false
-			err = saveUser(user)
+			err = saveUser(ctx, user)
 			if err != nil {
 				logger.Errorf("ERROR SAVING USER: %v", err)
-				return
+				continue
+			}
+			if err := setGrantStatus(ctx, cid.String(), GrantConfirmed); err != nil {
+				logger.Errorf("ERROR SAVING GRANT: %v", err)
 			}
-		} else if finished {
-			logger.Errorf("TRANSACTION FAILED: %v", mLookup.Receipt.ExitCode.Error())
-			return
+			reconciled(FaucetMode, outcomeConfirmed)
+		} else {
+			// the user stays locked until an admin unlocks, fails or re-drives the grant
+			logger.Errorf("TRANSACTION FAILED: User ID %q, Cid %q: %v", user.ID, cid, inc.Receipt.ExitCode.Error())
+			reconciled(FaucetMode, outcomeFailed)
+			if err := setGrantStatus(ctx, cid.String(), GrantFailed); err != nil {
+				logger.Errorf("ERROR SAVING GRANT: %v", err)
+			}
+		}
+	}
+}
+
+// followGrantMessage looks for a user's grant message on chain and records how far it got. It returns the
+// inclusion once the message is CONFIRMATION_DEPTH epochs deep, and nil while it is pending or not deep
+// enough yet. A message a reorg took off the chain goes back to pending.
+func followGrantMessage(ctx context.Context, mode Mode, userID string, c cid.Cid) (*msgInclusion, error) {
+	inc, err := lotusSearchMessageInclusion(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	if inc == nil {
+		reorged, err := revertGrantIncluded(ctx, c.String())
+		if err != nil {
+			logger.Errorf("ERROR SAVING GRANT: %v", err)
+		}
+		if reorged {
+			logger.Errorf("MESSAGE REORGED OUT, BACK TO PENDING: User ID %q, Cid %q", userID, c)
+			reconciled(mode, outcomeReorged)
+		} else {
+			reconciled(mode, outcomePending)
+		}
+		return nil, nil
+	}
+
+	senders := faucetSenders
+	if mode == VerifierMode {
+		senders = verifierSenders
+	}
+	senders.done(c)
+
+	if !inc.deep() {
+		if err := setGrantIncluded(ctx, c.String(), inc.Height); err != nil {
+			logger.Errorf("ERROR SAVING GRANT: %v", err)
 		}
+		reconciled(mode, outcomeIncluded)
+		return nil, nil
 	}
+	return inc, nil
 }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/guregu/dynamo"
+	"github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrUserNotLocked    = errors.New("user is not locked")
+	ErrGrantSucceeded   = errors.New("the grant message succeeded on chain, unlock the user instead")
+	ErrGrantMaybeInPool = errors.New("the grant message was not found on chain and may still be in the mempool, force the re-drive to send it again")
+)
+
+// Chain statuses reported for a locked user's pending message
+const (
+	ChainStatusNotFound = "NOT_FOUND"
+	ChainStatusSuccess  = "SUCCESS"
+	ChainStatusFailed   = "FAILED"
+	ChainStatusUnknown  = "UNKNOWN"
+)
+
+// LockedGrant is a locked user along with where their last message is at on chain
+type LockedGrant struct {
+	UserID      string `json:"userID"`
+	Username    string `json:"username"`
+	Address     string `json:"address"`
+	Cid         string `json:"cid"`
+	ChainStatus string `json:"chainStatus"`
+	ExitCode    string `json:"exitCode,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// lockedGrantTarget returns the address and message CID of the grant a user is locked on
+func lockedGrantTarget(user User, lock UserLock) (string, string) {
+	if lock == UserLock_Faucet {
+		return user.MostRecentFaucetAddress, user.MostRecentFaucetGrantCid
+	}
+	return user.MostRecentVerifiedAddress, user.MostRecentDataCapCid
+}
+
+func isUserLocked(user User, lock UserLock) bool {
+	if lock == UserLock_Faucet {
+		return user.Locked_Faucet
+	}
+	return user.Locked_Verifier
+}
+
+func lockedGrantStatus(ctx context.Context, user User, lock UserLock) LockedGrant {
+	addr, msgCid := lockedGrantTarget(user, lock)
+	lg := LockedGrant{
+		UserID:      user.ID,
+		Username:    user.Accounts["github"].Username,
+		Address:     addr,
+		Cid:         msgCid,
+		ChainStatus: ChainStatusUnknown,
+	}
+
+	c, err := cid.Decode(msgCid)
+	if err != nil {
+		lg.Error = errors.Wrap(err, "decoding cid").Error()
+		return lg
+	}
+	mLookup, err := lotusSearchMessageResult(ctx, c)
+	if err != nil {
+		lg.Error = errors.Wrap(err, "searching message").Error()
+		return lg
+	}
+
+	if mLookup == nil {
+		lg.ChainStatus = ChainStatusNotFound
+	} else if mLookup.Receipt.ExitCode.IsSuccess() {
+		lg.ChainStatus = ChainStatusSuccess
+		if lock == UserLock_Verifier && msigEnabled() {
+			// the proposal landed, but the multisig may have failed or cancelled it, the reconcile job
+			// marks the grant failed then
+			grant, err := getGrant(ctx, msgCid)
+			if err != nil && err != dynamo.ErrNotFound {
+				lg.ChainStatus = ChainStatusUnknown
+				lg.Error = errors.Wrap(err, "getting grant").Error()
+			} else if err == nil && grant.Status == GrantFailed {
+				lg.ChainStatus = ChainStatusFailed
+				lg.Error = "the multisig proposal failed"
+			}
+		}
+	} else {
+		lg.ChainStatus = ChainStatusFailed
+		lg.ExitCode = mLookup.Receipt.ExitCode.String()
+	}
+	return lg
+}
+
+func listLockedGrants(ctx context.Context, lock UserLock) ([]LockedGrant, error) {
+	users, err := getLockedUsers(ctx, lock)
+	if err != nil {
+		return nil, err
+	}
+
+	grants := make([]LockedGrant, 0, len(users))
+	for _, user := range users {
+		grants = append(grants, lockedGrantStatus(ctx, user, lock))
+	}
+	return grants, nil
+}
+
+// failLockedGrant gives up on a user's last message and lets them request again
+func failLockedGrant(ctx context.Context, userID string, lock UserLock) error {
+	user, err := getUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !isUserLocked(user, lock) {
+		return ErrUserNotLocked
+	}
+
+	_, msgCid := lockedGrantTarget(user, lock)
+	if msgCid != "" {
+		if err := setGrantStatus(ctx, msgCid, GrantFailed); err != nil {
+			return err
+		}
+	}
+	return unlockUser(ctx, userID, lock)
+}
+
+// redriveLockedGrant sends a locked user's grant again to the same address, the user stays locked until the
+// new message is reconciled. Without force it refuses to resend a message that could still land.
+func redriveLockedGrant(ctx context.Context, userID string, lock UserLock, force bool) (cid.Cid, error) {
+	user, err := getUserByID(ctx, userID)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if !isUserLocked(user, lock) {
+		return cid.Undef, ErrUserNotLocked
+	}
+
+	lg := lockedGrantStatus(ctx, user, lock)
+	switch lg.ChainStatus {
+	case ChainStatusSuccess:
+		return cid.Undef, ErrGrantSucceeded
+	case ChainStatusNotFound, ChainStatusUnknown:
+		if !force {
+			return cid.Undef, ErrGrantMaybeInPool
+		}
+	}
+
+	targetAddr, err := address.NewFromString(lg.Address)
+	if err != nil {
+		return cid.Undef, errors.Wrap(err, "parsing grant address")
+	}
+
+	var newCid cid.Cid
+	var amount string
+	if lock == UserLock_Faucet {
+		api, closer, err := lotusGetMpoolAPI(ctx)
+		if err != nil {
+			return cid.Undef, err
+		}
+		defer closer()
+
+		_, newCid, err = faucetSenders.send(ctx, big.Int(env.FaucetGrantSize), func(from address.Address) (cid.Cid, error) {
+			return lotusSendFIL(ctx, api, from, targetAddr, env.FaucetGrantSize)
+		})
+		if err != nil {
+			return cid.Undef, err
+		}
+		amount = env.FaucetGrantSize.String()
+		user.MostRecentFaucetGrantCid = newCid.String()
+	} else {
+		_, newCid, err = verifierSenders.send(ctx, env.MaxAllowanceBytes, func(from address.Address) (cid.Cid, error) {
+			return lotusVerifyAccount(ctx, from, lg.Address, env.MaxAllowanceBytes)
+		})
+		if err != nil {
+			return cid.Undef, err
+		}
+		amount = env.MaxAllowanceBytes.String()
+		user.MostRecentDataCapCid = newCid.String()
+		user.MostRecentMsigTxnID = ""
+		user.MostRecentMsigApproveCid = ""
+	}
+
+	if lg.Cid != "" {
+		if err := setGrantStatus(ctx, lg.Cid, GrantFailed); err != nil {
+			return newCid, err
+		}
+	}
+	mode := VerifierMode
+	if lock == UserLock_Faucet {
+		mode = FaucetMode
+	}
+	if err := saveGrant(ctx, newGrant(mode, user.ID, lg.Address, amount, newCid.String())); err != nil {
+		return newCid, err
+	}
+	return newCid, saveUser(ctx, user)
+}
@@ -11,23 +11,52 @@ import (
 
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/go-state-types/network"
 	"github.com/filecoin-project/lotus/api"
-	"github.com/filecoin-project/lotus/api/client"
-	"github.com/filecoin-project/lotus/api/v0api"
 	apibstore "github.com/filecoin-project/lotus/blockstore"
 	"github.com/filecoin-project/lotus/chain/actors"
+	"github.com/filecoin-project/lotus/chain/actors/adt"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/datacap"
+	lverifreg "github.com/filecoin-project/lotus/chain/actors/builtin/verifreg"
 	"github.com/filecoin-project/lotus/chain/types"
-	cliutil "github.com/filecoin-project/lotus/cli/util"
 	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/filecoin-project/specs-actors/actors/builtin/multisig"
 	"github.com/filecoin-project/specs-actors/actors/builtin/verifreg"
 	"github.com/ipfs/go-cid"
-	"github.com/ipfs/go-hamt-ipld"
 	cbor "github.com/ipfs/go-ipld-cbor"
-	cbg "github.com/whyrusleeping/cbor-gen"
 )
 
-func lotusVerifyAccount(ctx context.Context, targetAddr string, allowance types.BigInt) (cid.Cid, error) {
+// lotusGrantAllowance reads the allowance of an AddVerifiedClient message, sent directly or proposed to the
+// notary multisig
+func lotusGrantAllowance(ctx context.Context, lapi lotusAPI, c cid.Cid) (big.Int, error) {
+	msg, err := lapi.ChainGetMessage(ctx, c)
+	if err != nil {
+		return big.Int{}, err
+	}
+
+	method, params := msg.Method, msg.Params
+	if method == builtin.MethodsMultisig.Propose {
+		var p multisig.ProposeParams
+		if err := p.UnmarshalCBOR(bytes.NewReader(params)); err != nil {
+			return big.Int{}, errors.Wrap(err, "decoding proposal")
+		}
+		method, params = p.Method, p.Params
+	}
+	if method != builtin.MethodsVerifiedRegistry.AddVerifiedClient {
+		return big.Int{}, errors.Errorf("%v is not an AddVerifiedClient message", c)
+	}
+
+	var p verifreg.AddVerifiedClientParams
+	if err := p.UnmarshalCBOR(bytes.NewReader(params)); err != nil {
+		return big.Int{}, errors.Wrap(err, "decoding AddVerifiedClient")
+	}
+	return p.Allowance, nil
+}
+
+func lotusVerifyAccount(ctx context.Context, from address.Address, targetAddr string, allowance types.BigInt) (cid.Cid, error) {
 	target, err := address.NewFromString(targetAddr)
 	if err != nil {
 		return cid.Cid{}, err
@@ -38,21 +67,41 @@ func lotusVerifyAccount(ctx context.Context, targetAddr string, allowance types.
 		return cid.Cid{}, err
 	}
 
-	lapi, closer, err := lotusGetFullNodeAPI(ctx)
+	msg := &types.Message{
+		To:     builtin.VerifiedRegistryActorAddr,
+		From:   from,
+		Method: builtin.MethodsVerifiedRegistry.AddVerifiedClient,
+		Params: params,
+	}
+
+	// A multisig notary gets AddVerifiedClient proposed to it instead
+	if msigEnabled() {
+		msg, err = msigProposeMessage(from, msg)
+		if err != nil {
+			return cid.Cid{}, err
+		}
+	}
+
+	lapi, closer, err := lotusGetMpoolAPI(ctx)
 	if err != nil {
 		return cid.Cid{}, err
 	}
 	defer closer()
 
-	nonce, err := lapi.MpoolGetNonce(ctx, VerifierAddr)
+	return lotusPushMessage(ctx, lapi, msg, walletSignMessage)
+}
 
-	msg := &types.Message{
-		To:     builtin.VerifiedRegistryActorAddr,
-		From:   VerifierAddr,
-		Method: builtin.MethodsVerifiedRegistry.AddVerifiedClient,
-		Params: params,
-		Nonce:  nonce,
+// signFunc signs a message CID on behalf of an address
+type signFunc func(ctx context.Context, signerAddr address.Address, message []byte, msgMeta api.MsgMeta) (*crypto.Signature, error)
+
+// lotusPushMessage fills in the nonce and gas of msg, signs it and pushes it to the mempool. lapi should come
+// from lotusGetMpoolAPI.
+func lotusPushMessage(ctx context.Context, lapi lotusAPI, msg *types.Message, sign signFunc) (cid.Cid, error) {
+	nonce, err := lapi.MpoolGetNonce(ctx, msg.From)
+	if err != nil {
+		return cid.Cid{}, err
 	}
+	msg.Nonce = nonce
 
 	sendSpec := &api.MessageSendSpec{
 		MaxFee: types.BigInt(env.MaxFee),
@@ -63,7 +112,7 @@ func lotusVerifyAccount(ctx context.Context, targetAddr string, allowance types.
 		return cid.Cid{}, err
 	}
 
-	sig, err := walletSignMessage(ctx, VerifierAddr, msgWithGas.Cid().Bytes(), api.MsgMeta{Type: api.MTUnknown})
+	sig, err := sign(ctx, msg.From, msgWithGas.Cid().Bytes(), api.MsgMeta{Type: api.MTUnknown})
 	if err != nil {
 		return cid.Cid{}, err
 	}
@@ -77,52 +126,53 @@ func lotusVerifyAccount(ctx context.Context, targetAddr string, allowance types.
 
 type addrAndDataCap struct {
 	Address address.Address
-	DataCap verifreg.DataCap
+	DataCap abi.StoragePower
 }
 
-func lotusListVerifiers(ctx context.Context) ([]addrAndDataCap, error) {
-	api, closer, err := lotusGetFullNodeAPI(ctx)
+// lotusStateStore reads actor state at the head, through the node's blockstore
+func lotusStateStore(ctx context.Context, lapi lotusAPI) (adt.Store, *types.TipSet, error) {
+	head, err := lapi.ChainHead(ctx)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer closer()
+	return adt.WrapStore(ctx, cbor.NewCborStore(apibstore.NewAPIBlockstore(lapi))), head, nil
+}
 
-	act, err := api.StateGetActor(ctx, builtin.VerifiedRegistryActorAddr, types.EmptyTSK)
+// lotusLoadVerifreg loads the verified registry in whichever actor version the network runs
+func lotusLoadVerifreg(ctx context.Context, lapi lotusAPI, store adt.Store, tsk types.TipSetKey) (lverifreg.State, error) {
+	act, err := lapi.StateGetActor(ctx, lverifreg.Address, tsk)
 	if err != nil {
 		return nil, err
 	}
+	return lverifreg.Load(store, act)
+}
 
-	apibs := apibstore.NewAPIBlockstore(api)
-	cst := cbor.NewCborStore(apibs)
-
-	var st verifreg.State
-	if err := cst.Get(ctx, act.Head, &st); err != nil {
+func lotusListVerifiers(ctx context.Context) ([]addrAndDataCap, error) {
+	api, closer, err := lotusGetFullNodeAPI(ctx)
+	if err != nil {
 		return nil, err
 	}
+	defer closer()
 
-	vh, err := hamt.LoadNode(ctx, cst, st.Verifiers, hamt.UseTreeBitWidth(5))
+	store, head, err := lotusStateStore(ctx, api)
+	if err != nil {
+		return nil, err
+	}
+	st, err := lotusLoadVerifreg(ctx, api, store, head.Key())
 	if err != nil {
 		return nil, err
 	}
 
 	var resp []addrAndDataCap
-
-	err = vh.ForEach(ctx, func(k string, val interface{}) error {
-		addr, err := address.NewFromBytes([]byte(k))
-		if err != nil {
-			return err
-		}
-
-		var dcap verifreg.DataCap
-		if err := dcap.UnmarshalCBOR(bytes.NewReader(val.(*cbg.Deferred).Raw)); err != nil {
-			return err
-		}
+	err = st.ForEachVerifier(func(addr address.Address, dcap abi.StoragePower) error {
 		resp = append(resp, addrAndDataCap{addr, dcap})
 		return nil
 	})
 	return resp, err
 }
 
+// lotusListVerifiedClients reads client datacap from the verified registry, or from the datacap actor
+// since FIP-0045 (network version 17) moved it there
 func lotusListVerifiedClients(ctx context.Context) ([]addrAndDataCap, error) {
 	api, closer, err := lotusGetFullNodeAPI(ctx)
 	if err != nil {
@@ -130,39 +180,39 @@ func lotusListVerifiedClients(ctx context.Context) ([]addrAndDataCap, error) {
 	}
 	defer closer()
 
-	act, err := api.StateGetActor(ctx, builtin.VerifiedRegistryActorAddr, types.EmptyTSK)
+	store, head, err := lotusStateStore(ctx, api)
 	if err != nil {
 		return nil, err
 	}
-
-	apibs := apibstore.NewAPIBlockstore(api)
-	cst := cbor.NewCborStore(apibs)
-
-	var st verifreg.State
-	if err := cst.Get(ctx, act.Head, &st); err != nil {
-		return nil, err
-	}
-
-	vh, err := hamt.LoadNode(ctx, cst, st.VerifiedClients, hamt.UseTreeBitWidth(5))
+	nv, err := api.StateNetworkVersion(ctx, head.Key())
 	if err != nil {
 		return nil, err
 	}
 
 	var resp []addrAndDataCap
-	err = vh.ForEach(ctx, func(k string, val interface{}) error {
-		addr, err := address.NewFromBytes([]byte(k))
-		if err != nil {
-			return err
-		}
-
-		var dcap verifreg.DataCap
-		if err := dcap.UnmarshalCBOR(bytes.NewReader(val.(*cbg.Deferred).Raw)); err != nil {
-			return err
-		}
+	collect := func(addr address.Address, dcap abi.StoragePower) error {
 		resp = append(resp, addrAndDataCap{addr, dcap})
 		return nil
+	}
 
-	})
+	if nv < network.Version17 {
+		st, err := lotusLoadVerifreg(ctx, api, store, head.Key())
+		if err != nil {
+			return nil, err
+		}
+		err = st.ForEachClient(collect)
+		return resp, err
+	}
+
+	act, err := api.StateGetActor(ctx, datacap.Address, head.Key())
+	if err != nil {
+		return nil, err
+	}
+	st, err := datacap.Load(store, act)
+	if err != nil {
+		return nil, err
+	}
+	err = st.ForEachClient(collect)
 	return resp, err
 }
 
@@ -221,57 +271,52 @@ func lotusCheckVerifierRemainingBytes(ctx context.Context, targetAddr string) (b
 	return *dcap, nil
 }
 
-func lotusGetFullNodeAPI(ctx context.Context) (apiClient v0api.FullNode, closer jsonrpc.ClientCloser, err error) {
-	err = retry(ctx, func() error {
-		ainfo := cliutil.APIInfo{Token: []byte(env.LotusAPIToken)}
+func lotusGetFullNodeAPI(ctx context.Context) (apiClient lotusAPI, closer jsonrpc.ClientCloser, err error) {
+	ctx, span := tracer.Start(ctx, "lotusGetFullNodeAPI")
+	defer func() { endSpan(span, err) }()
 
+	// the connection is shared, so callers closing it is a no-op
+	closer = func() {}
+	err = retry(ctx, func() error {
 		var innerErr error
-		apiClient, closer, innerErr = client.NewFullNodeRPCV0(ctx, env.LotusAPIDialAddr, ainfo.AuthHeader())
+		apiClient, innerErr = lotusClient.get(ctx)
 		return innerErr
 	})
 	return
 }
 
-func lotusSendFIL(ctx context.Context, lapi v0api.FullNode, fromAddr, toAddr address.Address, filAmount types.FIL) (cid.Cid, error) {
-	nonce, err := lapi.MpoolGetNonce(ctx, fromAddr)
-	if err != nil {
-		return cid.Cid{}, err
-	}
+// lotusGetMpoolAPI is lotusGetFullNodeAPI for the endpoints that take messages
+func lotusGetMpoolAPI(ctx context.Context) (apiClient lotusAPI, closer jsonrpc.ClientCloser, err error) {
+	ctx, span := tracer.Start(ctx, "lotusGetMpoolAPI")
+	defer func() { endSpan(span, err) }()
+
+	closer = func() {}
+	err = retry(ctx, func() error {
+		var innerErr error
+		apiClient, innerErr = lotusClient.getMpool(ctx)
+		return innerErr
+	})
+	return
+}
 
+func lotusSendFIL(ctx context.Context, lapi lotusAPI, fromAddr, toAddr address.Address, filAmount types.FIL) (cid.Cid, error) {
 	msg := &types.Message{
 		From:  fromAddr,
 		To:    toAddr,
 		Value: types.BigInt(filAmount),
-		Nonce: nonce,
-	}
-
-	sendSpec := &api.MessageSendSpec{
-		MaxFee: types.BigInt(env.MaxFee),
-	}
-
-	msgWithGas, err := lapi.GasEstimateMessageGas(ctx, msg, sendSpec, types.EmptyTSK)
-	if err != nil {
-		return cid.Cid{}, err
-	}
-	sig, err := walletSignMessage(ctx, fromAddr, msgWithGas.Cid().Bytes(), api.MsgMeta{Type: api.MTUnknown})
-	if err != nil {
-		return cid.Cid{}, err
-	}
-
-	mCid, err := lapi.MpoolPush(ctx, &types.SignedMessage{Signature: *sig, Message: *msgWithGas})
-	if err != nil {
-		return cid.Cid{}, err
 	}
-	return mCid, nil
+	return lotusPushMessage(ctx, lapi, msg, walletSignMessage)
 }
 
 var errNotMiner = errors.New("not a miner")
 
+// lotusTranslateError turns the node's actor not found error into errNotMiner, the JSON-RPC client only
+// keeps its message
 func lotusTranslateError(err *error) {
 	if *err == nil {
 		return
 	}
-	if strings.Contains((*err).Error(), "not found") {
+	if errors.Is(*err, types.ErrActorNotFound) || strings.Contains((*err).Error(), types.ErrActorNotFound.Error()) {
 		*err = errNotMiner
 	}
 }
@@ -293,6 +338,58 @@ func lotusSearchMessageResult(ctx context.Context, cid cid.Cid) (*api.MsgLookup,
 	return mLookup, nil
 }
 
+// msgInclusion is a message found on the current chain, with the timestamp of the tipset it was included in
+// and how many epochs the head has moved past the one it executed in
+type msgInclusion struct {
+	*api.MsgLookup
+	Timestamp     time.Time
+	Confirmations abi.ChainEpoch
+}
+
+// deep is true once the message is CONFIRMATION_DEPTH epochs below the head, and no longer expected to be
+// reorged away
+func (m *msgInclusion) deep() bool {
+	return m.Confirmations >= abi.ChainEpoch(env.ConfirmationDepth)
+}
+
+// lotusSearchMessageInclusion looks for a message on the current chain. It returns nil while the message
+// isn't on it, which is also the case after a reorg took it off.
+func lotusSearchMessageInclusion(ctx context.Context, c cid.Cid) (*msgInclusion, error) {
+	lapi, closer, err := lotusGetFullNodeAPI(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+
+	mLookup, err := lapi.StateSearchMsg(ctx, c)
+	if err != nil || mLookup == nil {
+		return nil, err
+	}
+	head, err := lapi.ChainHead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := lapi.ChainGetTipSetByHeight(ctx, mLookup.Height, head.Key())
+	if err != nil {
+		return nil, err
+	}
+	if ts.Key() != mLookup.TipSet {
+		return nil, errors.Errorf("the head switched forks while searching for %v", c)
+	}
+	// the lookup has the tipset the message executed in, it was included in that tipset's parent, which is
+	// behind any null rounds below it
+	included, err := lapi.ChainGetTipSetByHeight(ctx, mLookup.Height-1, ts.Key())
+	if err != nil {
+		return nil, err
+	}
+
+	return &msgInclusion{
+		MsgLookup:     mLookup,
+		Timestamp:     time.Unix(int64(included.MinTimestamp()), 0),
+		Confirmations: head.Height() - mLookup.Height,
+	}, nil
+}
+
 func retry(ctx context.Context, fn func() error) (err error) {
 	wait := 5 * time.Second
 	for {
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
+)
+
+func TestLotusTranslateError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want error
+	}{
+		{types.ErrActorNotFound, errNotMiner},
+		// what the JSON-RPC client returns for an unknown Miner ID
+		{errors.New("resolution lookup failed (t01234): resolve address t01234: actor not found"), errNotMiner},
+		{errors.New("blockstore: block not found"), nil},
+		{errors.New("connection refused"), nil},
+	} {
+		err := tc.err
+		lotusTranslateError(&err)
+		if tc.want != nil && err != tc.want {
+			t.Errorf("expected %q to become %v, got %v", tc.err, tc.want, err)
+		}
+		if tc.want == nil && err != tc.err {
+			t.Errorf("expected %q to be kept, got %v", tc.err, err)
+		}
+	}
+}
+
+func TestMessageInclusionTimestamp(t *testing.T) {
+	s := newTestServer(t)
+	client := testClientAddr(t, "client")
+	var resp grantResponse
+	if code := s.post("/verify", client, &resp); code != http.StatusOK {
+		t.Fatalf("expected the grant to be sent, got %v %v", code, resp.Error)
+	}
+	s.mine(1)
+	c, err := cid.Decode(resp.Cid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the lookup is the tipset the message executed in, the timestamp is the one of its parent
+	lookup, err := s.node.StateSearchMsg(context.Background(), c)
+	if err != nil || lookup == nil {
+		t.Fatalf("expected the message on chain: %v", err)
+	}
+	s.node.lk.Lock()
+	s.node.epochs[lookup.Height-1] = fakeEpoch{timestamp: 1000}
+	s.node.epochs[lookup.Height] = fakeEpoch{timestamp: 1030}
+	s.node.lk.Unlock()
+
+	inc, err := lotusSearchMessageInclusion(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inc.Timestamp.Unix() != 1000 {
+		t.Fatalf("expected the timestamp of the inclusion tipset, got %v", inc.Timestamp.Unix())
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/go-state-types/abi"
+	verifregtypes "github.com/filecoin-project/go-state-types/builtin/v9/verifreg"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/go-state-types/network"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/client"
+	apibstore "github.com/filecoin-project/lotus/blockstore"
+	"github.com/filecoin-project/lotus/chain/types"
+	cliutil "github.com/filecoin-project/lotus/cli/util"
+	"github.com/ipfs/go-cid"
+)
+
+// lotusAPI is the part of the v0 full node API the verifier uses, v0api.FullNode satisfies it and so
+// does the fakeNode of the tests
+type lotusAPI interface {
+	// ChainIO lets the actor state be read through an API blockstore
+	apibstore.ChainIO
+
+	ChainHead(ctx context.Context) (*types.TipSet, error)
+	ChainGetTipSetByHeight(ctx context.Context, h abi.ChainEpoch, tsk types.TipSetKey) (*types.TipSet, error)
+	ChainGetMessage(ctx context.Context, c cid.Cid) (*types.Message, error)
+
+	MpoolGetNonce(ctx context.Context, addr address.Address) (uint64, error)
+	MpoolPush(ctx context.Context, smsg *types.SignedMessage) (cid.Cid, error)
+	GasEstimateMessageGas(ctx context.Context, msg *types.Message, spec *api.MessageSendSpec, tsk types.TipSetKey) (*types.Message, error)
+
+	StateGetActor(ctx context.Context, actor address.Address, tsk types.TipSetKey) (*types.Actor, error)
+	StateSearchMsg(ctx context.Context, msg cid.Cid) (*api.MsgLookup, error)
+	StateListMessages(ctx context.Context, match *api.MessageMatch, tsk types.TipSetKey, toht abi.ChainEpoch) ([]cid.Cid, error)
+	StateVerifierStatus(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*abi.StoragePower, error)
+	StateVerifiedClientStatus(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*abi.StoragePower, error)
+	StateListMiners(ctx context.Context, tsk types.TipSetKey) ([]address.Address, error)
+	StateMinerInfo(ctx context.Context, actor address.Address, tsk types.TipSetKey) (api.MinerInfo, error)
+	StateAccountKey(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error)
+	StateNetworkVersion(ctx context.Context, tsk types.TipSetKey) (network.Version, error)
+	StateLookupID(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error)
+	StateMarketDeals(ctx context.Context, tsk types.TipSetKey) (map[string]*api.MarketDeal, error)
+	StateGetAllocations(ctx context.Context, clientAddr address.Address, tsk types.TipSetKey) (map[verifregtypes.AllocationId]verifregtypes.Allocation, error)
+	StateGetClaims(ctx context.Context, providerAddr address.Address, tsk types.TipSetKey) (map[verifregtypes.ClaimId]verifregtypes.Claim, error)
+	MsigGetPending(ctx context.Context, addr address.Address, tsk types.TipSetKey) ([]*api.MsigTransaction, error)
+
+	WalletBalance(ctx context.Context, addr address.Address) (types.BigInt, error)
+	WalletHas(ctx context.Context, addr address.Address) (bool, error)
+	WalletSign(ctx context.Context, addr address.Address, msg []byte) (*crypto.Signature, error)
+}
+
+// lotusDialer opens a client to a node, the tests swap it to run the handlers against fakeNode
+var lotusDialer = dialLotus
+
+func dialLotus(ctx context.Context, addr, token string) (lotusAPI, jsonrpc.ClientCloser, error) {
+	ainfo := cliutil.APIInfo{Token: []byte(token)}
+	node, closer, err := client.NewFullNodeRPCV0(ctx, addr, ainfo.AuthHeader())
+	if err != nil {
+		return nil, nil, err
+	}
+	return instrumentFullNode(node), closer, nil
+}
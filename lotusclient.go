@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/glifio/go-logger"
+	"github.com/pkg/errors"
+)
+
+// lotusHealthTimeout bounds the ChainHead call of a health check
+const lotusHealthTimeout = 10 * time.Second
+
+// ErrNoLotusEndpoint is returned when no endpoint is configured
+var ErrNoLotusEndpoint = errors.New("no Lotus endpoint configured, set LOTUS_API_DIAL_ADDR or LOTUS_API_DIAL_ADDRS")
+
+// lotusEndpointState ranks endpoints when picking one
+type lotusEndpointState int
+
+const (
+	lotusHealthy lotusEndpointState = iota
+	lotusUnchecked
+	lotusUnhealthy
+)
+
+// lotusConn is a long-lived connection to one Lotus endpoint. A failed health check drops it and the next
+// call dials again.
+type lotusConn struct {
+	addr  string
+	token string
+
+	lk        sync.RWMutex
+	node      lotusAPI
+	closer    jsonrpc.ClientCloser
+	dials     int
+	state     lotusEndpointState
+	height    abi.ChainEpoch
+	headTime  time.Time
+	checkedAt time.Time
+	lastErr   error
+}
+
+// get returns the open connection, dialing if there is none
+func (l *lotusConn) get(ctx context.Context) (lotusAPI, error) {
+	l.lk.RLock()
+	node := l.node
+	l.lk.RUnlock()
+	if node != nil {
+		return node, nil
+	}
+
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	if l.node != nil {
+		return l.node, nil
+	}
+	node, closer, err := lotusDialer(ctx, l.addr, l.token)
+	if err != nil {
+		l.state = lotusUnhealthy
+		l.lastErr = err
+		return nil, err
+	}
+	l.node, l.closer = node, closer
+	l.dials++
+	if l.dials > 1 {
+		logger.Infof("Reconnected to Lotus at %v", l.addr)
+	}
+	return node, nil
+}
+
+// reset closes node if it is still the open connection
+func (l *lotusConn) reset(node lotusAPI) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	if l.node != node || node == nil {
+		return
+	}
+	l.closer()
+	l.node, l.closer = nil, nil
+}
+
+// check reads the head of the endpoint, redialing if it doesn't answer
+func (l *lotusConn) check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, lotusHealthTimeout)
+	defer cancel()
+
+	node, err := l.get(ctx)
+	if err != nil {
+		return err
+	}
+	head, err := node.ChainHead(ctx)
+	if err != nil {
+		logger.Errorf("LOTUS CONNECTION TO %v FAILED, RECONNECTING: %v", l.addr, err)
+		l.reset(node)
+	}
+
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	l.checkedAt = time.Now()
+	l.lastErr = err
+	if err != nil {
+		l.state = lotusUnhealthy
+		return err
+	}
+	l.height = head.Height()
+	l.headTime = time.Unix(int64(head.MinTimestamp()), 0)
+	if age := time.Since(l.headTime); age > env.LotusMaxHeadAge {
+		l.state = lotusUnhealthy
+		l.lastErr = errors.Errorf("head %d is %v old", l.height, age.Truncate(time.Second))
+		return l.lastErr
+	}
+	l.state = lotusHealthy
+	return nil
+}
+
+// markLagging flags an endpoint that is fresh but too far behind the others
+func (l *lotusConn) markLagging(best abi.ChainEpoch) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	if l.state == lotusHealthy && best-l.height > abi.ChainEpoch(env.LotusMaxHeightLag) {
+		l.state = lotusUnhealthy
+		l.lastErr = errors.Errorf("head %d is %d epochs behind", l.height, best-l.height)
+	}
+}
+
+func (l *lotusConn) close() {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	if l.node != nil {
+		l.closer()
+		l.node, l.closer = nil, nil
+	}
+}
+
+// LotusEndpointStatus is the health of one endpoint as shown on /healthz
+type LotusEndpointStatus struct {
+	Addr      string         `json:"addr"`
+	Read      bool           `json:"read"`
+	Push      bool           `json:"push"`
+	Healthy   bool           `json:"healthy"`
+	Connected bool           `json:"connected"`
+	Height    abi.ChainEpoch `json:"height,omitempty"`
+	HeadTime  *time.Time     `json:"headTime,omitempty"`
+	CheckedAt *time.Time     `json:"checkedAt,omitempty"`
+	LastError string         `json:"lastError,omitempty"`
+}
+
+// lotusPool holds the connections to every configured endpoint. Reads go to the first healthy read
+// endpoint and messages to the first healthy mpool endpoint, in the order they were configured.
+type lotusPool struct {
+	once sync.Once
+	err  error
+	read []*lotusConn
+	push []*lotusConn
+	all  []*lotusConn
+
+	suspect chan struct{}
+}
+
+var lotusClient = &lotusPool{suspect: make(chan struct{}, 1)}
+
+// init builds the connections from the environment, the first time it is needed
+func (p *lotusPool) init() error {
+	p.once.Do(func() {
+		byAddr := map[string]*lotusConn{}
+		conns := func(addrs, tokens []string) ([]*lotusConn, error) {
+			if len(tokens) > 1 && len(tokens) != len(addrs) {
+				return nil, errors.Errorf("got %d tokens for %d Lotus endpoints", len(tokens), len(addrs))
+			}
+			var out []*lotusConn
+			for i, addr := range addrs {
+				if conn, ok := byAddr[addr]; ok {
+					out = append(out, conn)
+					continue
+				}
+				token := env.LotusAPIToken
+				if len(tokens) == 1 {
+					token = tokens[0]
+				} else if len(tokens) > 1 {
+					token = tokens[i]
+				}
+				conn := &lotusConn{addr: addr, token: token, state: lotusUnchecked}
+				byAddr[addr] = conn
+				p.all = append(p.all, conn)
+				out = append(out, conn)
+			}
+			return out, nil
+		}
+
+		readAddrs := splitList(env.LotusAPIDialAddrs)
+		readTokens := splitList(env.LotusAPITokens)
+		if len(readAddrs) == 0 && env.LotusAPIDialAddr != "" {
+			readAddrs = []string{env.LotusAPIDialAddr}
+		}
+		if len(readAddrs) == 0 {
+			p.err = ErrNoLotusEndpoint
+			return
+		}
+		if p.read, p.err = conns(readAddrs, readTokens); p.err != nil {
+			return
+		}
+
+		pushAddrs := splitList(env.LotusMpoolDialAddrs)
+		if len(pushAddrs) == 0 {
+			p.push = p.read
+			return
+		}
+		p.push, p.err = conns(pushAddrs, splitList(env.LotusMpoolTokens))
+	})
+	return p.err
+}
+
+// pick tries the endpoints healthiest first, keeping the configured order within each state
+func (p *lotusPool) pick(ctx context.Context, conns []*lotusConn) (lotusAPI, error) {
+	ordered := append([]*lotusConn(nil), conns...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		ordered[i].lk.RLock()
+		si := ordered[i].state
+		ordered[i].lk.RUnlock()
+		ordered[j].lk.RLock()
+		sj := ordered[j].state
+		ordered[j].lk.RUnlock()
+		return si < sj
+	})
+
+	var err error
+	for _, conn := range ordered {
+		var node lotusAPI
+		node, err = conn.get(ctx)
+		if err == nil {
+			return node, nil
+		}
+		logger.Errorf("ERROR DIALING LOTUS AT %v: %v", conn.addr, err)
+	}
+	return nil, err
+}
+
+// get returns a connection for reading chain state
+func (p *lotusPool) get(ctx context.Context) (lotusAPI, error) {
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+	return p.pick(ctx, p.read)
+}
+
+// getMpool returns a connection for nonces, gas estimates and pushing messages
+func (p *lotusPool) getMpool(ctx context.Context) (lotusAPI, error) {
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+	return p.pick(ctx, p.push)
+}
+
+// check checks every endpoint, then flags the ones lagging behind the best head
+func (p *lotusPool) check(ctx context.Context) {
+	if err := p.init(); err != nil {
+		logger.Errorf("LOTUS HEALTH CHECK FAILED: %v", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, conn := range p.all {
+		wg.Add(1)
+		go func(conn *lotusConn) {
+			defer wg.Done()
+			if err := conn.check(ctx); err != nil {
+				logger.Errorf("LOTUS HEALTH CHECK FAILED FOR %v: %v", conn.addr, err)
+			}
+		}(conn)
+	}
+	wg.Wait()
+
+	var best abi.ChainEpoch
+	for _, conn := range p.all {
+		conn.lk.RLock()
+		if conn.state == lotusHealthy && conn.height > best {
+			best = conn.height
+		}
+		conn.lk.RUnlock()
+	}
+	for _, conn := range p.all {
+		conn.markLagging(best)
+	}
+}
+
+// callFailed is told about every failed Lotus call, it schedules a health check without waiting for it
+func (p *lotusPool) callFailed() {
+	select {
+	case p.suspect <- struct{}{}:
+	default:
+	}
+}
+
+// start checks the endpoints every LOTUS_HEALTH_CHECK_INTERVAL, and right after a call fails
+func (p *lotusPool) start() {
+	go func() {
+		ticker := time.NewTicker(env.LotusHealthCheckInterval)
+		defer ticker.Stop()
+		for {
+			p.check(context.Background())
+			select {
+			case <-ticker.C:
+			case <-p.suspect:
+			}
+		}
+	}()
+}
+
+// healthy is true when there is a healthy endpoint for both reads and pushes
+func (p *lotusPool) healthy() bool {
+	if p.init() != nil {
+		return false
+	}
+	anyHealthy := func(conns []*lotusConn) bool {
+		for _, conn := range conns {
+			conn.lk.RLock()
+			ok := conn.state == lotusHealthy
+			conn.lk.RUnlock()
+			if ok {
+				return true
+			}
+		}
+		return false
+	}
+	return anyHealthy(p.read) && anyHealthy(p.push)
+}
+
+func (p *lotusPool) status() []LotusEndpointStatus {
+	if p.init() != nil {
+		return nil
+	}
+	in := func(conns []*lotusConn, conn *lotusConn) bool {
+		for _, c := range conns {
+			if c == conn {
+				return true
+			}
+		}
+		return false
+	}
+
+	var out []LotusEndpointStatus
+	for _, conn := range p.all {
+		conn.lk.RLock()
+		s := LotusEndpointStatus{
+			Addr:      conn.addr,
+			Read:      in(p.read, conn),
+			Push:      in(p.push, conn),
+			Healthy:   conn.state == lotusHealthy,
+			Connected: conn.node != nil,
+			Height:    conn.height,
+		}
+		if !conn.headTime.IsZero() {
+			headTime := conn.headTime
+			s.HeadTime = &headTime
+		}
+		if !conn.checkedAt.IsZero() {
+			checkedAt := conn.checkedAt
+			s.CheckedAt = &checkedAt
+		}
+		if conn.lastErr != nil {
+			s.LastError = conn.lastErr.Error()
+		}
+		conn.lk.RUnlock()
+		out = append(out, s)
+	}
+	return out
+}
+
+func (p *lotusPool) close() {
+	for _, conn := range p.all {
+		conn.close()
+	}
+}
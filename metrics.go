@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"reflect"
+	"time"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/v0api"
+	"github.com/glifio/go-logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/robfig/cron.v2"
+)
+
+var (
+	grantRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verifier_grant_requests_total",
+		Help: "Faucet and datacap requests received",
+	}, []string{"mode"})
+	grantsGranted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verifier_grants_granted_total",
+		Help: "Grant messages pushed to the mempool",
+	}, []string{"mode"})
+	grantRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verifier_grants_rejected_total",
+		Help: "Requests turned down, by reason",
+	}, []string{"mode", "reason"})
+
+	lotusRPCDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "verifier_lotus_rpc_duration_seconds",
+		Help:    "Latency of Lotus API calls",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"method"})
+	lotusRPCErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verifier_lotus_rpc_errors_total",
+		Help: "Lotus API calls that returned an error",
+	}, []string{"method"})
+
+	reconcileOutcomes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verifier_reconcile_outcomes_total",
+		Help: "What the reconcile jobs found for each locked user's message",
+	}, []string{"mode", "outcome"})
+
+	budgetUsed = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "verifier_budget_used",
+		Help: "Amount used in the current window of each budget",
+	}, []string{"budget"})
+	budgetLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "verifier_budget_limit",
+		Help: "Limit of each budget per window",
+	}, []string{"budget"})
+	faucetBalance = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "verifier_faucet_balance_fil",
+		Help: "Balance of each faucet sender",
+	}, []string{"address"})
+	verifierDataCap = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "verifier_datacap_bytes",
+		Help: "Remaining datacap of each notary",
+	}, []string{"address"})
+	lockedUsers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "verifier_locked_users",
+		Help: "Users waiting on a grant message",
+	}, []string{"mode"})
+)
+
+// Reconcile outcomes
+const (
+	outcomeConfirmed = "confirmed"
+	outcomeFailed    = "failed"
+	outcomePending   = "pending"
+	outcomeIncluded  = "included"
+	outcomeReorged   = "reorged"
+	outcomeError     = "error"
+)
+
+func grantRejected(mode Mode, reason string) {
+	grantRejections.WithLabelValues(string(mode), reason).Inc()
+}
+
+func reconciled(mode Mode, outcome string) {
+	reconcileOutcomes.WithLabelValues(string(mode), outcome).Inc()
+}
+
+// instrumentFullNode wraps every method of a Lotus API client to record its latency and errors, and trace it
+func instrumentFullNode(in v0api.FullNode) lotusAPI {
+	inStruct, ok := in.(*v0api.FullNodeStruct)
+	if !ok {
+		return in
+	}
+
+	var out v0api.FullNodeStruct
+	outs := api.GetInternalStructs(&out)
+	ins := api.GetInternalStructs(inStruct)
+	errType := reflect.TypeOf((*error)(nil)).Elem()
+	ctxType := reflect.TypeOf((*context.Context)(nil)).Elem()
+
+	for i := range outs {
+		rin := reflect.ValueOf(ins[i]).Elem()
+		rout := reflect.ValueOf(outs[i]).Elem()
+		for f := 0; f < rout.NumField(); f++ {
+			field := rout.Type().Field(f)
+			fn := rin.Field(f)
+			if field.Type.Kind() != reflect.Func || fn.IsNil() {
+				continue
+			}
+
+			method := field.Name
+			returnsErr := field.Type.NumOut() > 0 && field.Type.Out(field.Type.NumOut()-1) == errType
+			takesCtx := field.Type.NumIn() > 0 && field.Type.In(0) == ctxType
+			rout.Field(f).Set(reflect.MakeFunc(field.Type, func(args []reflect.Value) []reflect.Value {
+				var span trace.Span
+				if takesCtx {
+					var ctx context.Context
+					ctx, span = tracer.Start(args[0].Interface().(context.Context), "lotus."+method, trace.WithSpanKind(trace.SpanKindClient))
+					args[0] = reflect.ValueOf(ctx)
+				}
+
+				start := time.Now()
+				res := fn.Call(args)
+				lotusRPCDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+
+				var err error
+				if returnsErr && !res[len(res)-1].IsNil() {
+					err = res[len(res)-1].Interface().(error)
+					lotusRPCErrors.WithLabelValues(method).Inc()
+					lotusClient.callFailed()
+				}
+				if span != nil {
+					endSpan(span, err)
+				}
+				return res
+			}))
+		}
+	}
+	return &out
+}
+
+func startMetrics(c *cron.Cron) {
+	if _, err := c.AddFunc("@every 1m", collectMetrics); err != nil {
+		logger.Errorf("ERROR SCHEDULING METRICS: %v", err)
+	}
+}
+
+// collectMetrics refreshes the gauges that need a query to Redis, Lotus or Dynamo
+func collectMetrics() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	for _, b := range allBudgets() {
+		if !b.enabled() {
+			continue
+		}
+		used, err := b.used(ctx)
+		if err != nil {
+			logger.Errorf("ERROR COLLECTING BUDGET METRICS: %v", err)
+			continue
+		}
+		budgetUsed.WithLabelValues(b.name).Set(float64(used))
+		budgetLimit.WithLabelValues(b.name).Set(float64(b.limit))
+	}
+
+	if env.Mode != VerifierMode {
+		for _, addr := range faucetSenders.addrs() {
+			bal, err := faucetSenders.fetchAvailable(ctx, addr)
+			if err != nil {
+				logger.Errorf("ERROR COLLECTING BALANCE METRICS: %v", err)
+				continue
+			}
+			fil, _ := new(big.Float).Quo(new(big.Float).SetInt(bal.Int), big.NewFloat(1e18)).Float64()
+			faucetBalance.WithLabelValues(addr.String()).Set(fil)
+		}
+		countLockedUsers(ctx, FaucetMode, UserLock_Faucet)
+	}
+
+	if env.Mode != FaucetMode {
+		addrs := verifierSenders.addrs()
+		if verifierSenders.sharedAvailable() {
+			addrs = addrs[:1]
+		}
+		for _, addr := range addrs {
+			dcap, err := verifierSenders.fetchAvailable(ctx, addr)
+			if err != nil {
+				logger.Errorf("ERROR COLLECTING DATACAP METRICS: %v", err)
+				continue
+			}
+			notary := addr
+			if verifierSenders.sharedAvailable() {
+				notary = notaryAddr()
+			}
+			bytes, _ := new(big.Float).SetInt(dcap.Int).Float64()
+			verifierDataCap.WithLabelValues(notary.String()).Set(bytes)
+		}
+		countLockedUsers(ctx, VerifierMode, UserLock_Verifier)
+	}
+}
+
+func countLockedUsers(ctx context.Context, mode Mode, lock UserLock) {
+	users, err := getLockedUsers(ctx, lock)
+	if err != nil {
+		logger.Errorf("ERROR COLLECTING LOCKED USER METRICS: %v", err)
+		return
+	}
+	lockedUsers.WithLabelValues(string(mode)).Set(float64(len(users)))
+}
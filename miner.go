@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/chain/actors/builtin"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/lib/sigs"
+	_ "github.com/filecoin-project/lotus/lib/sigs/bls"
+	_ "github.com/filecoin-project/lotus/lib/sigs/secp"
+	"github.com/gin-gonic/gin"
+	"github.com/glifio/go-logger"
+	"github.com/pkg/errors"
+)
+
+// MinerRecipient picks which of a miner's addresses receives its faucet grant
+type MinerRecipient string
+
+const (
+	MinerRecipientWorker MinerRecipient = "worker"
+	MinerRecipientOwner  MinerRecipient = "owner"
+)
+
+const minerChallengePrefix = "verifier-faucet-miner"
+
+var (
+	ErrMinerChallengeRequired = errors.New("Sign the challenge from GET /faucet/<miner ID>/challenge with the owner or worker key of the miner.")
+	ErrMinerChallengeInvalid  = errors.New("The miner challenge is invalid or has expired. Please request a new one.")
+	ErrMinerSignatureInvalid  = errors.New("The signature is not from the owner or worker key of this miner.")
+	ErrMinerLimitReached      = errors.New("This Miner ID has reached its maximum usage of the faucet.")
+)
+
+// minerGrant is a faucet grant to a storage provider, sent to one of its key addresses
+type minerGrant struct {
+	miner     address.Address
+	recipient address.Address
+}
+
+// minerChallengeRequest is the body of POST /faucet/:target_addr for a miner ID
+type minerChallengeRequest struct {
+	Challenge string `json:"challenge"`
+	Signature string `json:"signature"`
+}
+
+// minerKeys are the owner and worker of a miner, as ID addresses and the key addresses that sign for them
+type minerKeys struct {
+	owner, worker       address.Address
+	ownerKey, workerKey address.Address
+}
+
+// lotusMinerKeys returns the keys of addr, or errNotMiner when it isn't a storage miner actor
+func lotusMinerKeys(ctx context.Context, addr address.Address) (minerKeys, error) {
+	lapi, closer, err := lotusGetFullNodeAPI(ctx)
+	if err != nil {
+		return minerKeys{}, err
+	}
+	defer closer()
+
+	act, err := lapi.StateGetActor(ctx, addr, types.EmptyTSK)
+	lotusTranslateError(&err)
+	if err != nil {
+		return minerKeys{}, err
+	}
+	if !builtin.IsStorageMinerActor(act.Code) {
+		return minerKeys{}, errNotMiner
+	}
+
+	info, err := lapi.StateMinerInfo(ctx, addr, types.EmptyTSK)
+	if err != nil {
+		return minerKeys{}, err
+	}
+	keys := minerKeys{owner: info.Owner, worker: info.Worker}
+	if keys.ownerKey, err = lapi.StateAccountKey(ctx, info.Owner, types.EmptyTSK); err != nil {
+		// a multisig owner has no key, the worker can still sign
+		keys.ownerKey = address.Undef
+	}
+	if keys.workerKey, err = lapi.StateAccountKey(ctx, info.Worker, types.EmptyTSK); err != nil {
+		return minerKeys{}, errors.Wrapf(err, "resolving worker %v", info.Worker)
+	}
+	return keys, nil
+}
+
+// minerChallenge is stateless: it carries the user, miner and expiry, MACed with JWT_SECRET
+func minerChallenge(userID string, miner address.Address, expires time.Time) string {
+	payload := fmt.Sprintf("%s:%s:%s:%d", minerChallengePrefix, miner, userID, expires.Unix())
+	return payload + ":" + minerChallengeMAC(payload)
+}
+
+func minerChallengeMAC(payload string) string {
+	mac := hmac.New(sha256.New, []byte(env.JWTSecret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkMinerChallenge makes sure challenge was issued by us to userID for miner, and hasn't expired
+func checkMinerChallenge(challenge, userID string, miner address.Address) error {
+	i := strings.LastIndex(challenge, ":")
+	if i < 0 {
+		return ErrMinerChallengeInvalid
+	}
+	payload, mac := challenge[:i], challenge[i+1:]
+	if !hmac.Equal([]byte(mac), []byte(minerChallengeMAC(payload))) {
+		return ErrMinerChallengeInvalid
+	}
+
+	parts := strings.Split(payload, ":")
+	if len(parts) != 4 || parts[0] != minerChallengePrefix || parts[1] != miner.String() || parts[2] != userID {
+		return ErrMinerChallengeInvalid
+	}
+	expires, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil || time.Now().After(time.Unix(expires, 0)) {
+		return ErrMinerChallengeInvalid
+	}
+	return nil
+}
+
+// verifyMinerGrant checks the challenge in the request was signed by the owner or worker of miner. It returns
+// the rejection reason with the error. The per-miner limit is reserved later, with reserveMinerSlot.
+func verifyMinerGrant(c *gin.Context, userID string, miner address.Address, keys minerKeys) (*minerGrant, string, int, error) {
+	var req minerChallengeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Challenge == "" || req.Signature == "" {
+		return nil, "miner_challenge_missing", http.StatusBadRequest, ErrMinerChallengeRequired
+	}
+	if err := checkMinerChallenge(req.Challenge, userID, miner); err != nil {
+		return nil, "miner_challenge_invalid", http.StatusForbidden, err
+	}
+
+	// the signature is what `lotus wallet sign` prints: hex of the type byte and the signature
+	sigBytes, err := hex.DecodeString(strings.TrimPrefix(req.Signature, "0x"))
+	if err != nil {
+		return nil, "miner_signature_invalid", http.StatusBadRequest, ErrMinerSignatureInvalid
+	}
+	var sig crypto.Signature
+	if err := sig.UnmarshalBinary(sigBytes); err != nil {
+		return nil, "miner_signature_invalid", http.StatusBadRequest, ErrMinerSignatureInvalid
+	}
+	signed := false
+	for _, key := range []address.Address{keys.ownerKey, keys.workerKey} {
+		if key != address.Undef && sigs.Verify(&sig, key, []byte(req.Challenge)) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return nil, "miner_signature_invalid", http.StatusForbidden, ErrMinerSignatureInvalid
+	}
+
+	recipient := keys.worker
+	if MinerRecipient(env.FaucetMinerRecipient) == MinerRecipientOwner {
+		recipient = keys.owner
+	}
+	return &minerGrant{miner: miner, recipient: recipient}, "", 0, nil
+}
+
+// serveMinerChallenge hands out a challenge for the owner or worker of a miner to sign
+func serveMinerChallenge(c *gin.Context) {
+	userID, err := getUserIDFromJWT(c)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	miner, err := address.NewFromString(c.Param("target_addr"))
+	if err != nil || miner.Protocol() != address.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expected a Miner ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(detachedContext(c), 30*time.Second)
+	defer cancel()
+	keys, err := lotusMinerKeys(ctx, miner)
+	if err == errNotMiner {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Errorf("ERROR GETTING MINER INFO: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	expires := time.Now().Add(env.FaucetMinerChallengeTTL)
+	challenge := minerChallenge(userID, miner, expires)
+	signers := []string{keys.workerKey.String()}
+	if keys.ownerKey != address.Undef {
+		signers = append(signers, keys.ownerKey.String())
+	}
+
+	type Response struct {
+		Challenge string    `json:"challenge"`
+		Message   string    `json:"message"`
+		Signers   []string  `json:"signers"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+	c.JSON(http.StatusOK, Response{
+		Challenge: challenge,
+		Message:   hex.EncodeToString([]byte(challenge)),
+		Signers:   signers,
+		ExpiresAt: expires.UTC(),
+	})
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/actors"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/filecoin-project/specs-actors/actors/builtin/multisig"
+	"github.com/glifio/go-logger"
+	"github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
+)
+
+// VerifierMsigAddr is the multisig holding the notary role when VERIFIER_MSIG_ADDR is set
+var VerifierMsigAddr address.Address
+
+// MsigApproverAddr is the second signer that approves our own proposals, its key is held by the signer like
+// the verifier keys. It's set from VERIFIER_MSIG_APPROVER_PK, or VERIFIER_MSIG_APPROVER_ADDR with a remote signer.
+var MsigApproverAddr address.Address
+
+// msigState is how far a proposal got through the multisig
+type msigState int
+
+const (
+	msigPending msigState = iota
+	msigExecuted
+	msigFailed
+)
+
+func msigEnabled() bool {
+	return env.VerifierMsigAddr != ""
+}
+
+func msigApproverEnabled() bool {
+	return MsigApproverAddr != address.Undef
+}
+
+// notaryAddr is the address holding the verifier datacap
+func notaryAddr() address.Address {
+	if msigEnabled() {
+		return VerifierMsigAddr
+	}
+	return VerifierAddr
+}
+
+func initMsig(ctx context.Context) error {
+	if !msigEnabled() {
+		return nil
+	}
+
+	var err error
+	VerifierMsigAddr, err = address.NewFromString(env.VerifierMsigAddr)
+	if err != nil {
+		return errors.Wrap(err, "parsing VERIFIER_MSIG_ADDR")
+	}
+	return nil
+}
+
+// msigProposeMessage wraps inner in a proposal to the notary multisig, sent from proposer
+func msigProposeMessage(proposer address.Address, inner *types.Message) (*types.Message, error) {
+	value := inner.Value
+	if value.Int == nil {
+		value = big.Zero()
+	}
+	params, err := actors.SerializeParams(&multisig.ProposeParams{
+		To:     inner.To,
+		Value:  value,
+		Method: inner.Method,
+		Params: inner.Params,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.Message{
+		To:     VerifierMsigAddr,
+		From:   proposer,
+		Method: builtin.MethodsMultisig.Propose,
+		Params: params,
+	}, nil
+}
+
+// lotusMsigApprove approves a pending proposal with the approver key, through the signer
+func lotusMsigApprove(ctx context.Context, txnID int64) (cid.Cid, error) {
+	params, aerr := actors.SerializeParams(&multisig.TxnIDParams{ID: multisig.TxnID(txnID)})
+	if aerr != nil {
+		return cid.Cid{}, aerr
+	}
+
+	lapi, closer, err := lotusGetMpoolAPI(ctx)
+	if err != nil {
+		return cid.Cid{}, err
+	}
+	defer closer()
+
+	msg := &types.Message{
+		To:     VerifierMsigAddr,
+		From:   MsigApproverAddr,
+		Method: builtin.MethodsMultisig.Approve,
+		Params: params,
+	}
+	return lotusPushMessage(ctx, lapi, msg, walletSignMessage)
+}
+
+// reconcileMsigProposal follows a landed proposal until the multisig executes it. It approves with the
+// approver key, again if that approval failed on chain, and otherwise waits for the other signers.
+func reconcileMsigProposal(ctx context.Context, user *User, proposal *msgInclusion) (msigState, error) {
+	if user.MostRecentMsigTxnID == "" {
+		var ret multisig.ProposeReturn
+		if err := ret.UnmarshalCBOR(bytes.NewReader(proposal.Receipt.Return)); err != nil {
+			return msigPending, errors.Wrap(err, "decoding propose return")
+		}
+		if ret.Applied {
+			if !ret.Code.IsSuccess() {
+				return msigFailed, errors.Errorf("proposal %d executed with exit code %v", ret.TxnID, ret.Code)
+			}
+			return msigExecuted, nil
+		}
+
+		user.MostRecentMsigTxnID = strconv.FormatInt(int64(ret.TxnID), 10)
+		if err := saveUser(ctx, *user); err != nil {
+			return msigPending, err
+		}
+	}
+
+	txnID, err := strconv.ParseInt(user.MostRecentMsigTxnID, 10, 64)
+	if err != nil {
+		return msigFailed, errors.Wrap(err, "parsing proposal ID")
+	}
+
+	lapi, closer, err := lotusGetFullNodeAPI(ctx)
+	if err != nil {
+		return msigPending, err
+	}
+	defer closer()
+
+	pending, err := lapi.MsigGetPending(ctx, VerifierMsigAddr, types.EmptyTSK)
+	if err != nil {
+		return msigPending, err
+	}
+	stillPending := false
+	for _, txn := range pending {
+		if txn.ID == txnID {
+			stillPending = true
+			break
+		}
+	}
+	if !stillPending {
+		// The proposal left the pending set, it was either executed or cancelled
+		return lotusMsigOutcome(ctx, lapi, txnID, proposal.Height)
+	}
+
+	// Still short of approvals, or waiting on the other signers
+	if !msigApproverEnabled() {
+		return msigPending, nil
+	}
+	if user.MostRecentMsigApproveCid != "" {
+		failed, err := msigApprovalFailed(ctx, user.MostRecentMsigApproveCid)
+		if err != nil || !failed {
+			return msigPending, err
+		}
+		logger.Errorf("MULTISIG APPROVAL FAILED, APPROVING AGAIN: User ID %q, proposal %d, Cid %q", user.ID, txnID, user.MostRecentMsigApproveCid)
+	}
+
+	approveCid, err := lotusMsigApprove(ctx, txnID)
+	if err != nil {
+		return msigPending, errors.Wrapf(err, "approving proposal %d", txnID)
+	}
+	user.MostRecentMsigApproveCid = approveCid.String()
+	return msigPending, saveUser(ctx, *user)
+}
+
+// msigApprovalFailed is true once our approval is CONFIRMATION_DEPTH deep with a failed receipt
+func msigApprovalFailed(ctx context.Context, approveCid string) (bool, error) {
+	c, err := cid.Decode(approveCid)
+	if err != nil {
+		return false, errors.Wrap(err, "decoding approval CID")
+	}
+	inc, err := lotusSearchMessageInclusion(ctx, c)
+	if err != nil || inc == nil || !inc.deep() {
+		return false, err
+	}
+	return !inc.Receipt.ExitCode.IsSuccess(), nil
+}
+
+// lotusMsigOutcome tells how a proposal that left the pending set ended, from the receipt of the approval
+// that executed it or of the cancel that dropped it. Only messages since the proposal landed are searched.
+func lotusMsigOutcome(ctx context.Context, lapi lotusAPI, txnID int64, since abi.ChainEpoch) (msigState, error) {
+	head, err := lapi.ChainHead(ctx)
+	if err != nil {
+		return msigPending, err
+	}
+	msgs, err := lapi.StateListMessages(ctx, &api.MessageMatch{To: VerifierMsigAddr}, head.Key(), since)
+	if err != nil {
+		return msigPending, err
+	}
+
+	for _, c := range msgs {
+		msg, err := lapi.ChainGetMessage(ctx, c)
+		if err != nil {
+			return msigPending, err
+		}
+		if msg.Method != builtin.MethodsMultisig.Approve && msg.Method != builtin.MethodsMultisig.Cancel {
+			continue
+		}
+		var params multisig.TxnIDParams
+		if err := params.UnmarshalCBOR(bytes.NewReader(msg.Params)); err != nil || int64(params.ID) != txnID {
+			continue
+		}
+
+		inc, err := lotusSearchMessageInclusion(ctx, c)
+		if err != nil {
+			return msigPending, err
+		}
+		if inc == nil || !inc.Receipt.ExitCode.IsSuccess() {
+			// an approval that lost the race to execute, or one taken off by a reorg
+			continue
+		}
+		if !inc.deep() {
+			return msigPending, nil
+		}
+		if msg.Method == builtin.MethodsMultisig.Cancel {
+			return msigFailed, errors.Errorf("proposal %d was cancelled by %v", txnID, msg.From)
+		}
+
+		var ret multisig.ApproveReturn
+		if err := ret.UnmarshalCBOR(bytes.NewReader(inc.Receipt.Return)); err != nil {
+			return msigPending, errors.Wrap(err, "decoding approve return")
+		}
+		if !ret.Applied {
+			continue
+		}
+		if !ret.Code.IsSuccess() {
+			return msigFailed, errors.Errorf("proposal %d executed with exit code %v", txnID, ret.Code)
+		}
+		return msigExecuted, nil
+	}
+	return msigPending, errors.Errorf("proposal %d is no longer pending, but no approval or cancel of it is on chain", txnID)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/gin-gonic/gin"
+	"github.com/glifio/go-logger"
+	"github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
+	"gopkg.in/robfig/cron.v2"
+)
+
+// ErrNotaryReportNotReady is returned until the first report is built
+var ErrNotaryReportNotReady = errors.New("the notary report is not ready yet")
+
+// ProviderUsage is how much of a client's verified datacap went to one storage provider
+type ProviderUsage struct {
+	Provider    string  `json:"provider"`
+	Deals       int     `json:"deals"`
+	ActiveDeals int     `json:"activeDeals"`
+	Bytes       big.Int `json:"bytes"`
+}
+
+// NotaryClientReport is one client this notary verified
+type NotaryClientReport struct {
+	Address     string          `json:"address"`
+	IDAddress   string          `json:"idAddress,omitempty"`
+	Grants      int             `json:"grants"`
+	FirstGrant  time.Time       `json:"firstGrant"`
+	LastGrant   time.Time       `json:"lastGrant"`
+	Granted     big.Int         `json:"granted"`
+	Remaining   big.Int         `json:"remaining"`
+	Deals       int             `json:"deals"`
+	ActiveDeals int             `json:"activeDeals"`
+	DealBytes   big.Int         `json:"dealBytes"`
+	Providers   []ProviderUsage `json:"providers"`
+}
+
+// NotaryReport joins our confirmed datacap grants with the chain, for Filecoin Plus reporting
+type NotaryReport struct {
+	Notary      string         `json:"notary"`
+	Height      abi.ChainEpoch `json:"height"`
+	GeneratedAt time.Time      `json:"generatedAt"`
+	Granted     big.Int        `json:"granted"`
+	Remaining   big.Int        `json:"remaining"`
+	DealBytes   big.Int        `json:"dealBytes"`
+	// BackfilledGrants were made before grants were recorded. Only the last grant of each of those users is
+	// known, so their earlier grants are missing from the report.
+	BackfilledGrants int                  `json:"backfilledGrants"`
+	Clients          []NotaryClientReport `json:"clients"`
+}
+
+var (
+	notaryReportLk   sync.RWMutex
+	notaryReportLast *NotaryReport
+	notaryReportErr  error
+)
+
+// startNotaryReport builds the report now and on NOTARY_REPORT_SCHEDULE, reading every market deal is too
+// heavy to do per request
+func startNotaryReport(c *cron.Cron) {
+	go refreshNotaryReport()
+	if _, err := c.AddFunc(env.NotaryReportSchedule, refreshNotaryReport); err != nil {
+		logger.Errorf("ERROR SCHEDULING NOTARY REPORT: %v", err)
+	}
+}
+
+func refreshNotaryReport() {
+	ctx, span := tracer.Start(context.Background(), "refreshNotaryReport")
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Minute)
+	defer cancel()
+
+	report, err := buildNotaryReport(ctx)
+	if err != nil {
+		logger.Errorf("ERROR BUILDING NOTARY REPORT: %v", err)
+	}
+
+	notaryReportLk.Lock()
+	defer notaryReportLk.Unlock()
+	notaryReportErr = err
+	if err == nil {
+		notaryReportLast = report
+	}
+}
+
+// grantBackfillDone is set once every grant from before grant records is recorded, until then each report
+// tries the missing ones again
+var (
+	grantBackfillLk   sync.Mutex
+	grantBackfillDone bool
+)
+
+// backfillVerifierGrants records the datacap grants made before grants were recorded, from each user's last
+// grant. The allowance is read from the message on chain.
+func backfillVerifierGrants(ctx context.Context) error {
+	grantBackfillLk.Lock()
+	defer grantBackfillLk.Unlock()
+	if grantBackfillDone {
+		return nil
+	}
+
+	grants, err := getGrants(ctx, VerifierMode, "")
+	if err != nil {
+		return errors.Wrap(err, "getting grants")
+	}
+	recorded := map[string]bool{}
+	for _, g := range grants {
+		recorded[g.Cid] = true
+	}
+	users, err := getUsersWithDataCapGrant(ctx)
+	if err != nil {
+		return errors.Wrap(err, "getting users")
+	}
+
+	lapi, closer, err := lotusGetFullNodeAPI(ctx)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	failed := 0
+	for _, user := range users {
+		// a locked user's grant hasn't gone through yet
+		if user.Locked_Verifier || recorded[user.MostRecentDataCapCid] {
+			continue
+		}
+		c, err := cid.Decode(user.MostRecentDataCapCid)
+		if err != nil {
+			logger.Errorf("ERROR DECODING DATACAP CID OF USER %q: %v", user.ID, err)
+			failed++
+			continue
+		}
+		amount, err := lotusGrantAllowance(ctx, lapi, c)
+		if err != nil {
+			logger.Errorf("ERROR BACKFILLING GRANT %v OF USER %q: %v", c, user.ID, err)
+			failed++
+			continue
+		}
+
+		grant := newGrant(VerifierMode, user.ID, user.MostRecentVerifiedAddress, amount.String(), c.String())
+		grant.Status = GrantConfirmed
+		grant.CreatedAt, grant.UpdatedAt = user.MostRecentAllocation, user.MostRecentAllocation
+		grant.Backfilled = true
+		if err := saveGrantIfMissing(ctx, grant); err != nil {
+			return errors.Wrap(err, "saving grant")
+		}
+	}
+	// the users that failed are tried again on the next report, the ones recorded now are skipped
+	if failed > 0 {
+		logger.Errorf("ERROR BACKFILLING GRANTS: %d users failed, retrying on the next report", failed)
+		return nil
+	}
+	grantBackfillDone = true
+	return nil
+}
+
+func buildNotaryReport(ctx context.Context) (*NotaryReport, error) {
+	if err := backfillVerifierGrants(ctx); err != nil {
+		return nil, errors.Wrap(err, "backfilling grants")
+	}
+	grants, err := getGrants(ctx, VerifierMode, GrantConfirmed)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting grants")
+	}
+
+	lapi, closer, err := lotusGetFullNodeAPI(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+	head, err := lapi.ChainHead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tsk := head.Key()
+
+	report := &NotaryReport{
+		Notary:      notaryAddr().String(),
+		Height:      head.Height(),
+		GeneratedAt: time.Now().UTC(),
+		Granted:     big.Zero(),
+		Remaining:   big.Zero(),
+		DealBytes:   big.Zero(),
+		Clients:     []NotaryClientReport{},
+	}
+
+	// deals can name the client by its ID or its robust address, so index both
+	clients := map[string]*NotaryClientReport{}
+	byAddr := map[address.Address]*NotaryClientReport{}
+	for _, g := range grants {
+		amount, err := big.FromString(g.Amount)
+		if err != nil {
+			logger.Errorf("ERROR PARSING GRANT AMOUNT %q OF %v: %v", g.Amount, g.Cid, err)
+			continue
+		}
+
+		cr, ok := clients[g.Address]
+		if !ok {
+			addr, err := address.NewFromString(g.Address)
+			if err != nil {
+				logger.Errorf("ERROR PARSING GRANT ADDRESS %q OF %v: %v", g.Address, g.Cid, err)
+				continue
+			}
+			cr = &NotaryClientReport{
+				Address:    g.Address,
+				FirstGrant: g.CreatedAt,
+				Granted:    big.Zero(),
+				Remaining:  big.Zero(),
+				DealBytes:  big.Zero(),
+			}
+			clients[g.Address] = cr
+			byAddr[addr] = cr
+
+			idAddr, err := lapi.StateLookupID(ctx, addr, tsk)
+			if err == nil {
+				cr.IDAddress = idAddr.String()
+				byAddr[idAddr] = cr
+			} else if ignoreNotFound(err) != nil {
+				return nil, errors.Wrapf(err, "looking up %v", addr)
+			}
+
+			dcap, err := lapi.StateVerifiedClientStatus(ctx, addr, tsk)
+			if ignoreNotFound(err) != nil {
+				return nil, errors.Wrapf(err, "getting datacap of %v", addr)
+			}
+			if dcap != nil && dcap.Int != nil {
+				cr.Remaining = *dcap
+			}
+		}
+
+		if g.Backfilled {
+			report.BackfilledGrants++
+		}
+		cr.Grants++
+		cr.Granted = big.Add(cr.Granted, amount)
+		if g.CreatedAt.Before(cr.FirstGrant) {
+			cr.FirstGrant = g.CreatedAt
+		}
+		if g.CreatedAt.After(cr.LastGrant) {
+			cr.LastGrant = g.CreatedAt
+		}
+	}
+
+	deals, err := lapi.StateMarketDeals(ctx, tsk)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting market deals")
+	}
+	providers := map[*NotaryClientReport]map[address.Address]*ProviderUsage{}
+	for _, deal := range deals {
+		if !deal.Proposal.VerifiedDeal {
+			continue
+		}
+		cr, ok := byAddr[deal.Proposal.Client]
+		if !ok {
+			continue
+		}
+
+		if providers[cr] == nil {
+			providers[cr] = map[address.Address]*ProviderUsage{}
+		}
+		pu, ok := providers[cr][deal.Proposal.Provider]
+		if !ok {
+			pu = &ProviderUsage{Provider: deal.Proposal.Provider.String(), Bytes: big.Zero()}
+			providers[cr][deal.Proposal.Provider] = pu
+		}
+
+		size := big.NewIntUnsigned(uint64(deal.Proposal.PieceSize))
+		active := deal.State.SectorStartEpoch > 0
+		cr.Deals++
+		pu.Deals++
+		if active {
+			cr.ActiveDeals++
+			pu.ActiveDeals++
+		}
+		cr.DealBytes = big.Add(cr.DealBytes, size)
+		pu.Bytes = big.Add(pu.Bytes, size)
+	}
+
+	for _, cr := range clients {
+		for _, pu := range providers[cr] {
+			cr.Providers = append(cr.Providers, *pu)
+		}
+		sort.Slice(cr.Providers, func(i, j int) bool { return cr.Providers[i].Bytes.GreaterThan(cr.Providers[j].Bytes) })
+		if cr.Providers == nil {
+			cr.Providers = []ProviderUsage{}
+		}
+
+		report.Granted = big.Add(report.Granted, cr.Granted)
+		report.Remaining = big.Add(report.Remaining, cr.Remaining)
+		report.DealBytes = big.Add(report.DealBytes, cr.DealBytes)
+		report.Clients = append(report.Clients, *cr)
+	}
+	sort.Slice(report.Clients, func(i, j int) bool { return report.Clients[i].FirstGrant.Before(report.Clients[j].FirstGrant) })
+	return report, nil
+}
+
+// serveNotaryReport returns the last report, as JSON or with format=csv one row per client
+func serveNotaryReport(c *gin.Context) {
+	notaryReportLk.RLock()
+	report, err := notaryReportLast, notaryReportErr
+	notaryReportLk.RUnlock()
+	if report == nil {
+		if err == nil {
+			err = ErrNotaryReportNotReady
+		}
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+
+	if c.Query("format") != "csv" && !strings.Contains(c.GetHeader("Accept"), "text/csv") {
+		c.JSON(http.StatusOK, report)
+		return
+	}
+
+	c.Header("Content-Type", "text/csv")
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"address", "id_address", "grants", "first_grant", "last_grant", "granted", "remaining", "deals", "active_deals", "deal_bytes", "providers"})
+	for _, cr := range report.Clients {
+		var providers []string
+		for _, pu := range cr.Providers {
+			providers = append(providers, pu.Provider)
+		}
+		w.Write([]string{
+			cr.Address,
+			cr.IDAddress,
+			strconv.Itoa(cr.Grants),
+			cr.FirstGrant.Format(time.RFC3339),
+			cr.LastGrant.Format(time.RFC3339),
+			cr.Granted.String(),
+			cr.Remaining.String(),
+			strconv.Itoa(cr.Deals),
+			strconv.Itoa(cr.ActiveDeals),
+			cr.DealBytes.String(),
+			strings.Join(providers, ";"),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		logger.Errorf("ERROR WRITING CSV: %v", err)
+	}
+}
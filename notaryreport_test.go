@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestGrantBackfillRetriesFailedUsers(t *testing.T) {
+	newTestServer(t)
+	grantBackfillDone = false
+	defer func() { grantBackfillDone = false }()
+
+	ctx := context.Background()
+	broken := User{ID: "broken-user", MostRecentDataCapCid: "not a cid"}
+	if err := saveUser(ctx, broken); err != nil {
+		t.Fatal(err)
+	}
+	if err := backfillVerifierGrants(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if grantBackfillDone {
+		t.Fatal("expected the backfill to be tried again after a user failed")
+	}
+
+	broken.MostRecentDataCapCid = ""
+	if err := saveUser(ctx, broken); err != nil {
+		t.Fatal(err)
+	}
+	if err := backfillVerifierGrants(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !grantBackfillDone {
+		t.Fatal("expected the backfill to be done once every user went through")
+	}
+}
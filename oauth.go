@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
@@ -12,7 +13,7 @@ type OAuthProvider struct {
 	ClientID         string
 	ClientSecret     string
 	TokenEndpoint    string
-	FetchAccountData func(token string) (AccountData, error)
+	FetchAccountData func(ctx context.Context, token string) (AccountData, error)
 }
 
 type GithubOAuthRequest struct {
@@ -34,16 +35,15 @@ func RegisterOAuthProvider(name string, provider OAuthProvider) {
 	oauthProviders[name] = provider
 }
 
-func OAuthExchangeCodeForToken(provider OAuthProvider, code, state string) (string, error) {
+func OAuthExchangeCodeForToken(ctx context.Context, provider OAuthProvider, code, state string) (string, error) {
 	// Create the request body
 	reqBody, err := json.Marshal(GithubOAuthRequest{provider.ClientID, provider.ClientSecret, code, state})
 	if err != nil {
 		return "", err
 	}
 
-	// Create HTTP client and request
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", provider.TokenEndpoint, bytes.NewBuffer(reqBody))
+	// Create the request
+	req, err := http.NewRequestWithContext(ctx, "POST", provider.TokenEndpoint, bytes.NewBuffer(reqBody))
 	if err != nil {
 		return "", err
 	}
@@ -51,7 +51,7 @@ func OAuthExchangeCodeForToken(provider OAuthProvider, code, state string) (stri
 	// Set headers and perform request
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
-	resp, err := client.Do(req)
+	resp, err := tracedHTTPClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/glifio/go-logger"
+)
+
+// pausedModes is only used when there's no redis to share the flags between replicas
+var pausedModes = make(map[Mode]bool)
+var pausedModesLk sync.RWMutex
+
+func pauseKey(mode Mode) string {
+	return env.DynamodbTableName + ":PAUSED:" + string(mode)
+}
+
+// isModePaused fails open, a redis outage shouldn't take the faucet or verifier down with it
+func isModePaused(mode Mode) bool {
+	if !redisEnabled() {
+		pausedModesLk.RLock()
+		defer pausedModesLk.RUnlock()
+		return pausedModes[mode]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	n, err := getRedis().Exists(ctx, pauseKey(mode)).Result()
+	if err != nil {
+		logger.Errorf("REDIS PAUSE LOOKUP FAILED: %v", err)
+		return false
+	}
+	return n > 0
+}
+
+func setModePaused(ctx context.Context, mode Mode, paused bool) error {
+	if !redisEnabled() {
+		pausedModesLk.Lock()
+		defer pausedModesLk.Unlock()
+		pausedModes[mode] = paused
+		return nil
+	}
+
+	rdb := getRedis()
+	if paused {
+		return rdb.Set(ctx, pauseKey(mode), time.Now().UTC().Format(time.RFC3339), 0).Err()
+	}
+	return rdb.Del(ctx, pauseKey(mode)).Err()
+}
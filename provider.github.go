@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -16,8 +17,8 @@ func init() {
 		ClientID:      env.GithubClientID,
 		ClientSecret:  env.GithubClientSecret,
 		TokenEndpoint: "https://github.com/login/oauth/access_token",
-		FetchAccountData: func(token string) (AccountData, error) {
-			resp, err := githubMakeAuthorizedRequest("https://api.github.com/user", token)
+		FetchAccountData: func(ctx context.Context, token string) (AccountData, error) {
+			resp, err := githubMakeAuthorizedRequest(ctx, "https://api.github.com/user", token)
 			if err != nil {
 				return AccountData{}, err
 			}
@@ -51,16 +52,14 @@ func init() {
 	})
 }
 
-func githubMakeAuthorizedRequest(url, token string) (io.ReadCloser, error) {
-	var client http.Client
-
-	req, err := http.NewRequest("GET", url, nil)
+func githubMakeAuthorizedRequest(ctx context.Context, url, token string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Authorization", "token "+token)
 
-	resp, err := client.Do(req)
+	resp, err := tracedHTTPClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
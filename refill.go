@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/glifio/go-logger"
+	"github.com/ipfs/go-cid"
+	"gopkg.in/robfig/cron.v2"
+)
+
+// RefillMode marks the grant records of treasury refills, their user ID is refillUserID
+const RefillMode Mode = "REFILL"
+
+const refillUserID = "treasury"
+
+// TreasuryAddr tops up the faucet senders when TREASURY_PK or TREASURY_ADDR is set
+var TreasuryAddr address.Address
+
+func refillEnabled() bool {
+	return env.Mode != VerifierMode && TreasuryAddr != address.Undef
+}
+
+func startRefill(c *cron.Cron) {
+	if !refillEnabled() {
+		return
+	}
+	if !big.Int(env.FaucetRefillLowFIL).LessThan(big.Int(env.FaucetRefillHighFIL)) {
+		logger.Errorf("FAUCET REFILL DISABLED: FAUCET_REFILL_LOW_FIL must be below FAUCET_REFILL_HIGH_FIL")
+		return
+	}
+	logger.Infof("Treasury address: %v", TreasuryAddr)
+	logger.Infof("Faucet refill: below %v up to %v, %v", env.FaucetRefillLowFIL, env.FaucetRefillHighFIL, env.FaucetRefillSchedule)
+	if _, err := c.AddFunc(env.FaucetRefillSchedule, refillFaucet); err != nil {
+		logger.Errorf("ERROR SCHEDULING FAUCET REFILL: %v", err)
+	}
+}
+
+// reconcileRefills settles the pending refills of a faucet sender, and reports whether one is still on its way.
+// A refill that isn't on chain after FAUCET_REFILL_TIMEOUT fails, so the sender can be refilled again.
+func reconcileRefills(ctx context.Context, pending []Grant, faucetAddr address.Address) bool {
+	inFlight := false
+	for _, g := range pending {
+		if g.Address != faucetAddr.String() {
+			continue
+		}
+		expired := time.Since(g.CreatedAt) > env.FaucetRefillTimeout
+		if g.Cid == "" {
+			// recorded, but we stopped before the push returned a CID
+			if !expired {
+				inFlight = true
+				continue
+			}
+			logger.Errorf("REFILL TIMED OUT: %q has no message after %v", g.ID, env.FaucetRefillTimeout)
+			if err := setGrantStatusByID(ctx, g.ID, GrantFailed); err != nil {
+				logger.Errorf("ERROR SAVING GRANT: %v", err)
+			}
+			continue
+		}
+
+		c, err := cid.Decode(g.Cid)
+		if err != nil {
+			logger.Errorf("ERROR DECODING REFILL CID: %v", err)
+			continue
+		}
+		inc, err := lotusSearchMessageInclusion(ctx, c)
+		if err != nil {
+			logger.Errorf("ERROR SEARCHING LOTUS MESSAGE: %v", err)
+			inFlight = true
+			continue
+		}
+		if inc == nil && expired {
+			logger.Errorf("REFILL TIMED OUT: Cid %q is not on chain after %v", g.Cid, env.FaucetRefillTimeout)
+			if err := setGrantStatusByID(ctx, g.ID, GrantFailed); err != nil {
+				logger.Errorf("ERROR SAVING GRANT: %v", err)
+			}
+			continue
+		}
+		// a refill stays pending until it is deep enough, so a reorg can't get it sent twice
+		if inc == nil || !inc.deep() {
+			inFlight = true
+			continue
+		}
+
+		status := GrantConfirmed
+		if !inc.Receipt.ExitCode.IsSuccess() {
+			logger.Errorf("REFILL FAILED: Cid %q: %v", g.Cid, inc.Receipt.ExitCode.Error())
+			status = GrantFailed
+		}
+		if err := setGrantStatusByID(ctx, g.ID, status); err != nil {
+			logger.Errorf("ERROR SAVING GRANT: %v", err)
+		}
+	}
+	return inFlight
+}
+
+// refillFaucet sends FIL from the treasury to every faucet sender below the low watermark, bringing it
+// back to the high watermark. A sender with a refill still in flight is skipped.
+func refillFaucet() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	pending, err := getGrants(ctx, RefillMode, GrantPending)
+	if err != nil {
+		logger.Errorf("ERROR GETTING PENDING REFILLS: %v", err)
+		return
+	}
+
+	lapi, closer, err := lotusGetFullNodeAPI(ctx)
+	if err != nil {
+		logger.Errorf("error getting FullNodeAPI: %v", err)
+		return
+	}
+	defer closer()
+
+	low := big.Int(env.FaucetRefillLowFIL)
+	high := big.Int(env.FaucetRefillHighFIL)
+
+	for _, faucetAddr := range faucetSenders.addrs() {
+		if reconcileRefills(ctx, pending, faucetAddr) {
+			continue
+		}
+
+		bal, err := lapi.WalletBalance(ctx, faucetAddr)
+		if err != nil {
+			logger.Errorf("ERROR CHECKING FAUCET BALANCE: %v", err)
+			continue
+		}
+		if !bal.LessThan(low) {
+			continue
+		}
+
+		amount := types.FIL(big.Sub(high, bal))
+		treasuryBal, err := lapi.WalletBalance(ctx, TreasuryAddr)
+		if err != nil {
+			logger.Errorf("ERROR CHECKING TREASURY BALANCE: %v", err)
+			return
+		}
+		if treasuryBal.LessThan(big.Int(amount)) {
+			logger.Errorf("TREASURY BALANCE TOO LOW: %v has %v, refilling %v needs %v", TreasuryAddr, types.FIL(treasuryBal), faucetAddr, amount)
+			return
+		}
+
+		mpool, mpoolCloser, err := lotusGetMpoolAPI(ctx)
+		if err != nil {
+			logger.Errorf("error getting FullNodeAPI: %v", err)
+			return
+		}
+
+		// the refill is recorded first, so it holds off the next run even if we stop right after the push
+		grant := newRefillGrant(faucetAddr.String(), amount.String())
+		if err := saveGrant(ctx, grant); err != nil {
+			mpoolCloser()
+			logger.Errorf("ERROR SAVING GRANT: %v", err)
+			continue
+		}
+		refillCid, err := lotusSendFIL(ctx, mpool, TreasuryAddr, faucetAddr, amount)
+		mpoolCloser()
+		if err != nil {
+			logger.Errorf("REFILL SEND FAILED: %v", err)
+			if err := setGrantStatusByID(ctx, grant.ID, GrantFailed); err != nil {
+				logger.Errorf("ERROR SAVING GRANT: %v", err)
+			}
+			continue
+		}
+		logger.Infof("Refilling faucet %v with %v from %v: %v", faucetAddr, amount, TreasuryAddr, refillCid)
+
+		if err := setGrantCid(ctx, grant.ID, refillCid.String()); err != nil {
+			logger.Errorf("ERROR SAVING GRANT: %v", err)
+		}
+	}
+}
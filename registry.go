@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/gin-gonic/gin"
+	"github.com/glifio/go-logger"
+	"github.com/pkg/errors"
+	"gopkg.in/robfig/cron.v2"
+)
+
+const (
+	registryDefaultPerPage = 100
+	registryMaxPerPage     = 1000
+)
+
+// ErrRegistryNotReady is returned until the first registry snapshot is taken
+var ErrRegistryNotReady = errors.New("the registry index is not ready yet")
+
+// registrySnapshot is the verified registry as of one tipset
+type registrySnapshot struct {
+	height    abi.ChainEpoch
+	takenAt   time.Time
+	verifiers []addrAndDataCap
+	clients   []addrAndDataCap
+}
+
+// registryIndex keeps the latest snapshot of notaries and verified clients, so the listings don't walk the
+// state on every request
+type registryIndex struct {
+	lk       sync.RWMutex
+	snapshot *registrySnapshot
+	lastErr  error
+}
+
+var registry = &registryIndex{}
+
+// startRegistryIndexer snapshots the registry now and on REGISTRY_INDEX_SCHEDULE
+func startRegistryIndexer(c *cron.Cron) {
+	go registry.refresh()
+	if _, err := c.AddFunc(env.RegistryIndexSchedule, registry.refresh); err != nil {
+		logger.Errorf("ERROR SCHEDULING REGISTRY INDEXER: %v", err)
+	}
+}
+
+// refresh takes a new snapshot, unless the head hasn't moved since the last one
+func (r *registryIndex) refresh() {
+	ctx, span := tracer.Start(context.Background(), "refreshRegistryIndex")
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	if err := r.refreshAt(ctx); err != nil {
+		logger.Errorf("ERROR INDEXING REGISTRY: %v", err)
+		r.lk.Lock()
+		r.lastErr = err
+		r.lk.Unlock()
+	}
+}
+
+func (r *registryIndex) refreshAt(ctx context.Context) error {
+	lapi, closer, err := lotusGetFullNodeAPI(ctx)
+	if err != nil {
+		return err
+	}
+	defer closer()
+	head, err := lapi.ChainHead(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.lk.RLock()
+	current := r.snapshot
+	r.lk.RUnlock()
+	if current != nil && current.height == head.Height() {
+		return nil
+	}
+
+	verifiers, err := lotusListVerifiers(ctx)
+	if err != nil {
+		return errors.Wrap(err, "listing verifiers")
+	}
+	clients, err := lotusListVerifiedClients(ctx)
+	if err != nil {
+		return errors.Wrap(err, "listing verified clients")
+	}
+
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.snapshot = &registrySnapshot{
+		height:    head.Height(),
+		takenAt:   time.Now(),
+		verifiers: verifiers,
+		clients:   clients,
+	}
+	r.lastErr = nil
+	return nil
+}
+
+func (r *registryIndex) get() (*registrySnapshot, error) {
+	r.lk.RLock()
+	defer r.lk.RUnlock()
+	if r.snapshot == nil {
+		if r.lastErr != nil {
+			return nil, errors.Wrap(r.lastErr, ErrRegistryNotReady.Error())
+		}
+		return nil, ErrRegistryNotReady
+	}
+	return r.snapshot, nil
+}
+
+// registryQuery is the filters, sort and page of a listing
+type registryQuery struct {
+	prefix     string
+	minDataCap big.Int
+	sort       string
+	desc       bool
+	paged      bool
+	page       int
+	perPage    int
+	csv        bool
+}
+
+func parseRegistryQuery(c *gin.Context) (registryQuery, error) {
+	q := registryQuery{
+		prefix:     c.Query("prefix"),
+		minDataCap: big.Zero(),
+		sort:       "address",
+		page:       1,
+		perPage:    registryDefaultPerPage,
+		csv:        c.Query("format") == "csv" || strings.Contains(c.GetHeader("Accept"), "text/csv"),
+	}
+
+	if v := c.Query("min_datacap"); v != "" {
+		minDataCap, err := big.FromString(v)
+		if err != nil {
+			return q, errors.Wrap(err, "parsing min_datacap")
+		}
+		q.minDataCap = minDataCap
+	}
+
+	if v := c.Query("sort"); v != "" {
+		q.desc = strings.HasPrefix(v, "-")
+		q.sort = strings.TrimPrefix(v, "-")
+		if q.sort != "address" && q.sort != "datacap" {
+			return q, errors.New("sort must be address or datacap, prefixed with - for descending")
+		}
+	}
+
+	// without page or per_page every match is returned, as before the listings were paged
+	if v := c.Query("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return q, errors.New("page must be a positive number")
+		}
+		q.page, q.paged = n, true
+	}
+	if v := c.Query("per_page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > registryMaxPerPage {
+			return q, errors.Errorf("per_page must be a positive number (max %d)", registryMaxPerPage)
+		}
+		q.perPage, q.paged = n, true
+	}
+	return q, nil
+}
+
+// apply filters and sorts entries, returning the matches before paging
+func (q registryQuery) apply(entries []addrAndDataCap) []addrAndDataCap {
+	var out []addrAndDataCap
+	for _, e := range entries {
+		if q.prefix != "" && !strings.HasPrefix(e.Address.String(), q.prefix) {
+			continue
+		}
+		if e.DataCap.LessThan(q.minDataCap) {
+			continue
+		}
+		out = append(out, e)
+	}
+
+	less := func(i, j int) bool { return out[i].Address.String() < out[j].Address.String() }
+	if q.sort == "datacap" {
+		less = func(i, j int) bool {
+			if cmp := out[i].DataCap.Cmp(out[j].DataCap.Int); cmp != 0 {
+				return cmp < 0
+			}
+			return out[i].Address.String() < out[j].Address.String()
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if q.desc {
+			return less(j, i)
+		}
+		return less(i, j)
+	})
+	return out
+}
+
+// serveRegistry lists verifiers or clients from the index. CSV and JSON without page or per_page return every
+// match, a paged JSON listing has the neighbouring pages in Link. The total is in X-Total-Count.
+func serveRegistry(c *gin.Context, entries func(*registrySnapshot) []addrAndDataCap) {
+	q, err := parseRegistryQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	snapshot, err := registry.get()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+
+	matches := q.apply(entries(snapshot))
+	c.Header("X-Total-Count", strconv.Itoa(len(matches)))
+	c.Header("X-Registry-Height", fmt.Sprintf("%d", snapshot.height))
+
+	if q.csv {
+		c.Header("Content-Type", "text/csv")
+		c.Status(http.StatusOK)
+		w := csv.NewWriter(c.Writer)
+		w.Write([]string{"address", "datacap"})
+		for _, e := range matches {
+			w.Write([]string{e.Address.String(), e.DataCap.String()})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			logger.Errorf("ERROR WRITING CSV: %v", err)
+		}
+		return
+	}
+	if !q.paged {
+		if matches == nil {
+			matches = []addrAndDataCap{}
+		}
+		c.JSON(http.StatusOK, matches)
+		return
+	}
+
+	start := (q.page - 1) * q.perPage
+	if start > len(matches) {
+		start = len(matches)
+	}
+	end := start + q.perPage
+	if end > len(matches) {
+		end = len(matches)
+	}
+	lastPage := (len(matches) + q.perPage - 1) / q.perPage
+	if lastPage == 0 {
+		lastPage = 1
+	}
+
+	var links []string
+	link := func(page int, rel string) {
+		u := url.URL{Path: c.Request.URL.Path}
+		params := c.Request.URL.Query()
+		params.Set("page", strconv.Itoa(page))
+		params.Set("per_page", strconv.Itoa(q.perPage))
+		u.RawQuery = params.Encode()
+		links = append(links, fmt.Sprintf("<%s>; rel=%q", u.String(), rel))
+	}
+	if q.page < lastPage {
+		link(q.page+1, "next")
+	}
+	if q.page > 1 {
+		link(q.page-1, "prev")
+	}
+	link(1, "first")
+	link(lastPage, "last")
+	c.Header("Link", strings.Join(links, ", "))
+
+	page := matches[start:end]
+	if page == nil {
+		page = []addrAndDataCap{}
+	}
+	c.JSON(http.StatusOK, page)
+}
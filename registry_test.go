@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/gin-gonic/gin"
+)
+
+func TestRegistryPaging(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var clients []addrAndDataCap
+	for i := 0; i < registryDefaultPerPage+50; i++ {
+		clients = append(clients, addrAndDataCap{testClientAddr(t, fmt.Sprint(i)), big.NewInt(int64(i))})
+	}
+	registry = &registryIndex{snapshot: &registrySnapshot{clients: clients}}
+	defer func() { registry = &registryIndex{} }()
+
+	router := gin.New()
+	router.GET("/verified-clients", func(c *gin.Context) {
+		serveRegistry(c, func(s *registrySnapshot) []addrAndDataCap { return s.clients })
+	})
+	get := func(query string) (*httptest.ResponseRecorder, []addrAndDataCap) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/verified-clients"+query, nil))
+		var out []addrAndDataCap
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w, out
+	}
+
+	// without paging params every match is listed
+	w, out := get("")
+	if w.Code != http.StatusOK || len(out) != len(clients) || w.Header().Get("Link") != "" {
+		t.Fatalf("expected all %d clients, got %d (%v)", len(clients), len(out), w.Code)
+	}
+
+	w, out = get("?page=2")
+	if len(out) != 50 || !strings.Contains(w.Header().Get("Link"), `rel="prev"`) {
+		t.Fatalf("expected the second page of %d, got %d", registryDefaultPerPage, len(out))
+	}
+
+	w, _ = get("?page=0")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "page must be a positive number\"") {
+		t.Fatalf("expected page to be rejected on its own, got %v %s", w.Code, w.Body)
+	}
+	w, _ = get("?per_page=1001")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "max 1000") {
+		t.Fatalf("expected per_page to be capped, got %v %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/glifio/go-logger"
+	"github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
+)
+
+var ErrNoSenderAvailable = errors.New("no sender has enough left for this grant")
+
+const (
+	// senderAvailableTTL is how long a sender's balance or datacap is trusted before asking the node again
+	senderAvailableTTL = time.Minute
+	// senderInFlightTTL forgets in-flight messages the reconcile job never reported back, e.g. after an admin unlock
+	senderInFlightTTL = 6 * time.Hour
+)
+
+// sender is one key of a pool and what we know about it
+type sender struct {
+	addr      address.Address
+	available big.Int
+	checkedAt time.Time
+	inFlight  map[cid.Cid]time.Time
+	sent      uint64
+	failures  uint64
+	lastError string
+}
+
+// senderPool spreads the grants of a mode over several keys, so they don't share a nonce stream and a
+// single balance or datacap
+type senderPool struct {
+	mode Mode
+
+	lk      sync.Mutex
+	senders []*sender
+}
+
+var (
+	faucetSenders   = &senderPool{mode: FaucetMode}
+	verifierSenders = &senderPool{mode: VerifierMode}
+)
+
+// setSenders installs the keys of a mode, the first one becomes FaucetAddr or VerifierAddr
+func setSenders(mode Mode, addrs []address.Address) {
+	if mode == FaucetMode {
+		FaucetAddr = addrs[0]
+		faucetSenders.setAddrs(addrs)
+	} else {
+		VerifierAddr = addrs[0]
+		verifierSenders.setAddrs(addrs)
+	}
+}
+
+// setAddrs replaces the keys of the pool, keeping what we know about keys that stay
+func (p *senderPool) setAddrs(addrs []address.Address) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	known := make(map[address.Address]*sender, len(p.senders))
+	for _, s := range p.senders {
+		known[s.addr] = s
+	}
+
+	senders := make([]*sender, 0, len(addrs))
+	for _, addr := range addrs {
+		s, ok := known[addr]
+		if !ok {
+			s = &sender{addr: addr, available: big.Zero(), inFlight: make(map[cid.Cid]time.Time)}
+		}
+		senders = append(senders, s)
+	}
+	p.senders = senders
+}
+
+func (p *senderPool) addrs() []address.Address {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	addrs := make([]address.Address, 0, len(p.senders))
+	for _, s := range p.senders {
+		addrs = append(addrs, s.addr)
+	}
+	return addrs
+}
+
+// sharedAvailable is true when every sender draws on the same datacap, i.e. they propose to one multisig
+func (p *senderPool) sharedAvailable() bool {
+	return p.mode == VerifierMode && msigEnabled()
+}
+
+// fetchAvailable asks the node for the balance of a faucet key or the datacap of a notary key
+func (p *senderPool) fetchAvailable(ctx context.Context, addr address.Address) (big.Int, error) {
+	if p.sharedAvailable() {
+		return lotusCheckVerifierRemainingBytes(ctx, notaryAddr().String())
+	}
+	if p.mode == VerifierMode {
+		return lotusCheckVerifierRemainingBytes(ctx, addr.String())
+	}
+
+	lapi, closer, err := lotusGetFullNodeAPI(ctx)
+	if err != nil {
+		return big.Int{}, err
+	}
+	defer closer()
+
+	bal, err := lapi.WalletBalance(ctx, addr)
+	if err != nil {
+		return big.Int{}, err
+	}
+	return bal, nil
+}
+
+// refresh updates the balances or datacap that are older than senderAvailableTTL
+func (p *senderPool) refresh(ctx context.Context) error {
+	p.lk.Lock()
+	var stale []address.Address
+	for _, s := range p.senders {
+		if time.Since(s.checkedAt) > senderAvailableTTL {
+			stale = append(stale, s.addr)
+		}
+	}
+	p.lk.Unlock()
+
+	var firstErr error
+	for _, addr := range stale {
+		available, err := p.fetchAvailable(ctx, addr)
+		if err != nil {
+			logger.Errorf("CHECKING SENDER %v FAILED: %v", addr, err)
+			p.lk.Lock()
+			for _, s := range p.senders {
+				if s.addr == addr {
+					s.lastError = err.Error()
+				}
+			}
+			p.lk.Unlock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		p.lk.Lock()
+		for _, s := range p.senders {
+			if s.addr == addr {
+				s.available, s.checkedAt = available, time.Now()
+			}
+		}
+		p.lk.Unlock()
+	}
+	return firstErr
+}
+
+// expireInFlight drops in-flight messages older than senderInFlightTTL, the caller holds p.lk
+func (p *senderPool) expireInFlight() {
+	for _, s := range p.senders {
+		for c, sentAt := range s.inFlight {
+			if time.Since(sentAt) > senderInFlightTTL {
+				delete(s.inFlight, c)
+			}
+		}
+	}
+}
+
+// candidates orders the senders that can still cover amount once their in-flight grants land, fewest
+// in-flight messages first and then the most left
+func (p *senderPool) candidates(amount big.Int) []address.Address {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.expireInFlight()
+
+	totalInFlight := 0
+	for _, s := range p.senders {
+		totalInFlight += len(s.inFlight)
+	}
+
+	type candidate struct {
+		addr     address.Address
+		inFlight int
+		headroom big.Int
+	}
+	var cands []candidate
+	for _, s := range p.senders {
+		if s.checkedAt.IsZero() {
+			continue
+		}
+		pending := len(s.inFlight)
+		if p.sharedAvailable() {
+			pending = totalInFlight
+		}
+		headroom := big.Sub(s.available, big.Mul(amount, big.NewInt(int64(pending))))
+		if headroom.LessThan(amount) {
+			continue
+		}
+		cands = append(cands, candidate{s.addr, len(s.inFlight), headroom})
+	}
+
+	sort.SliceStable(cands, func(i, j int) bool {
+		if cands[i].inFlight != cands[j].inFlight {
+			return cands[i].inFlight < cands[j].inFlight
+		}
+		return cands[i].headroom.GreaterThan(cands[j].headroom)
+	})
+
+	addrs := make([]address.Address, 0, len(cands))
+	for _, c := range cands {
+		addrs = append(addrs, c.addr)
+	}
+	return addrs
+}
+
+// send pushes a grant of amount from the best sender, failing over to the next one when the push fails
+func (p *senderPool) send(ctx context.Context, amount big.Int, push func(from address.Address) (cid.Cid, error)) (address.Address, cid.Cid, error) {
+	if err := p.refresh(ctx); err != nil && len(p.candidates(amount)) == 0 {
+		return address.Undef, cid.Undef, errors.Wrap(err, "checking senders")
+	}
+
+	cands := p.candidates(amount)
+	if len(cands) == 0 {
+		return address.Undef, cid.Undef, ErrNoSenderAvailable
+	}
+
+	var err error
+	for _, from := range cands {
+		var c cid.Cid
+		c, err = push(from)
+		if err != nil {
+			logger.Errorf("SENDER %v FAILED, TRYING THE NEXT ONE: %v", from, err)
+			p.recordFailure(from, err)
+			continue
+		}
+		p.track(from, c)
+		return from, c, nil
+	}
+	return address.Undef, cid.Undef, err
+}
+
+func (p *senderPool) recordFailure(addr address.Address, err error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	for _, s := range p.senders {
+		if s.addr == addr {
+			s.failures++
+			s.lastError = err.Error()
+			// ask the node again before picking this sender, it may have run dry
+			s.checkedAt = time.Time{}
+		}
+	}
+}
+
+func (p *senderPool) track(addr address.Address, c cid.Cid) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	for _, s := range p.senders {
+		if s.addr == addr {
+			s.sent++
+			s.inFlight[c] = time.Now()
+		}
+	}
+}
+
+// done stops counting a message as in flight once the reconcile job saw it land
+func (p *senderPool) done(c cid.Cid) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	for _, s := range p.senders {
+		if _, ok := s.inFlight[c]; ok {
+			delete(s.inFlight, c)
+			s.checkedAt = time.Time{}
+		}
+	}
+}
+
+// total is what all senders have left, or the multisig datacap they share. Senders the node can't be asked
+// about are left out, it only fails when none could be checked
+func (p *senderPool) total(ctx context.Context) (big.Int, error) {
+	refreshErr := p.refresh(ctx)
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	total, usable := big.Zero(), 0
+	for _, s := range p.senders {
+		if s.checkedAt.IsZero() {
+			continue
+		}
+		if p.sharedAvailable() {
+			return s.available, nil
+		}
+		total = big.Add(total, s.available)
+		usable++
+	}
+	if usable == 0 && refreshErr != nil {
+		return big.Int{}, refreshErr
+	}
+	return total, nil
+}
+
+// SenderStatus is what /admin/senders reports for each key
+type SenderStatus struct {
+	Address   string    `json:"address"`
+	Available string    `json:"available"`
+	CheckedAt time.Time `json:"checkedAt"`
+	InFlight  int       `json:"inFlight"`
+	Sent      uint64    `json:"sent"`
+	Failures  uint64    `json:"failures"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+func (p *senderPool) status() []SenderStatus {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.expireInFlight()
+
+	statuses := make([]SenderStatus, 0, len(p.senders))
+	for _, s := range p.senders {
+		available := s.available.String()
+		if p.mode == FaucetMode {
+			available = types.FIL(s.available).String()
+		}
+		statuses = append(statuses, SenderStatus{
+			Address:   s.addr.String(),
+			Available: available,
+			CheckedAt: s.checkedAt,
+			InFlight:  len(s.inFlight),
+			Sent:      s.sent,
+			Failures:  s.failures,
+			LastError: s.lastError,
+		})
+	}
+	return statuses
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+)
+
+func TestSenderPoolTotalSkipsFailedSenders(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	a, b := testClientAddr(t, "sender-a"), testClientAddr(t, "sender-b")
+	s.node.setBalance(a, big.NewInt(5))
+	s.node.setBalance(b, big.NewInt(7))
+
+	pool := &senderPool{mode: FaucetMode}
+	pool.setAddrs([]address.Address{a, b})
+	s.node.failBalance(b, errors.New("node unavailable"))
+	total, err := pool.total(ctx)
+	if err != nil {
+		t.Fatalf("expected a sender that can't be checked to be skipped: %v", err)
+	}
+	if !total.Equals(big.NewInt(5)) {
+		t.Fatalf("expected the total of the checked sender, got %v", total)
+	}
+
+	pool = &senderPool{mode: FaucetMode}
+	pool.setAddrs([]address.Address{a, b})
+	s.node.failBalance(a, errors.New("node unavailable"))
+	if _, err := pool.total(ctx); err == nil {
+		t.Fatal("expected an error when no sender can be checked")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -13,47 +14,55 @@ import (
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/glifio/go-logger"
+	"github.com/ipfs/go-cid"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 	"gopkg.in/robfig/cron.v2"
 )
 
 func startFaucet(router *gin.Engine, c *cron.Cron) {
-	logger.Infof("Faucet address: %v", FaucetAddr.String())
+	logger.Infof("Faucet addresses: %v", faucetSenders.addrs())
 	logger.Infof("Faucet grant size: %v", env.FaucetGrantSize)
 	logger.Infof("Faucet min GH account age days: %v", env.FaucetMinAccountAgeDays)
+	logger.Infof("Faucet window budget: %v", env.FaucetMaxWindowFIL)
 
 	// Add routes
 	router.POST("/faucet/:target_addr", serveFaucet, handleError("/faucet"))
+	router.GET("/faucet/:target_addr/challenge", serveMinerChallenge)
 
 	// Add cron jobs
 	c.AddFunc("@hourly", reconcileFaucetMessages)
 }
 
 func startVerifier(router *gin.Engine, c *cron.Cron) {
-	logger.Infof("Verifier address: %v", VerifierAddr.String())
+	logger.Infof("Verifier addresses: %v", verifierSenders.addrs())
+	if msigEnabled() {
+		logger.Infof("Verifier multisig: %v", VerifierMsigAddr.String())
+		logger.Infof("Verifier multisig auto-approver: %v", MsigApproverAddr.String())
+	}
 	logger.Infof("Verifier min GH account age days: %v", env.VerifierMinAccountAgeDays)
 	logger.Infof("Verifier rate limit: %v", env.VerifierRateLimit)
 	logger.Infof("Verifier base allowance: %v", env.BaseAllowanceBytes)
 	logger.Infof("Max allocations: %v", env.MaxTotalAllocations)
-
-	// Init counter
-	err := initCounter(&gin.Context{})
-	if err != nil {
-		logger.Errorf("REDIS INIT COUNT FAILED: %v", err)
-	}
+	logger.Infof("Max window allowance bytes: %v", env.MaxWindowAllowanceBytes)
+	logger.Infof("Verifier reserve bytes: %v", env.VerifierReserveBytes)
 
 	// Add routes
 	router.POST("/verify/:target_addr", serveVerifyAccount)
-	router.PUT("/verify/counter/:pwd", serveResetCounter)
-	router.GET("/verify/counter/:pwd", serveCurrentCount)
 	router.GET("/verifiers", serveListVerifiers)
 	router.GET("/verified-clients", serveListVerifiedClients)
+	router.GET("/notary-report", serveNotaryReport)
+	router.GET("/clients/:addr/allocations", serveClientAllocations)
 	router.GET("/allowance/:target_addr", serveAllowance)
 	router.GET("/account-remaining-bytes/:target_addr", serveCheckAccountRemainingBytes)
 	router.GET("/verifier-remaining-bytes/:target_addr", serveCheckVerifierRemainingBytes)
 
 	// Add cron jobs
 	c.AddFunc("@hourly", reconcileVerifierMessages)
+	startRegistryIndexer(c)
+	startNotaryReport(c)
+	startAllocationIndexer(c)
 }
 
 func main() {
@@ -70,15 +79,50 @@ func main() {
 		logger.Panic(err)
 	}
 
-	logger.Infof("Lotus node: %v", env.LotusAPIDialAddr)
+	// Running the binary without a subcommand starts the server
+	args := os.Args[1:]
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	os.Exit(runCommand(args))
+}
+
+func serve() error {
+	if err := lotusClient.init(); err != nil {
+		logger.Panic(err)
+	}
+	for _, s := range lotusClient.status() {
+		logger.Infof("Lotus node: %v (read: %v, mpool: %v)", s.Addr, s.Read, s.Push)
+	}
 	logger.Infof("Dynamodb table name: %v", env.DynamodbTableName)
 	logger.Infof("Max transaction fee: %v", env.MaxFee)
 	logger.Infof("Mode: %v", env.Mode)
 
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		logger.Panic(err)
+	}
+	defer shutdownTracing(context.Background())
+
 	if err := initBlockListCache(); err != nil {
 		logger.Panic(err)
 	}
-	if _, err := instantiateWallet(&gin.Context{}); err != nil {
+	logger.Infof("Allocations window: %v", env.AllocationsWindow)
+	if err := initCounter(); err != nil {
+		logger.Panic(err)
+	}
+	if err := pingCounter(context.Background()); err != nil {
+		logger.Errorf("REDIS INIT COUNT FAILED: %v", err)
+	}
+	lotusClient.start()
+	defer lotusClient.close()
+	logger.Infof("Signer backend: %v", env.SignerBackend)
+	if err := signers.load(context.Background()); err != nil {
+		logger.Panic(err)
+	}
+	defer signers.close()
+	reloadSignerOnSIGHUP()
+	if err := initMsig(context.Background()); err != nil {
 		logger.Panic(err)
 	}
 
@@ -87,6 +131,7 @@ func main() {
 	if logger.IsSentryEnabled() {
 		router.Use(logger.GetSentryGin())
 	}
+	router.Use(otelgin.Middleware(env.TracesServiceName))
 
 	// Set CORS headers
 	router.Use(cors.New(cors.Config{
@@ -100,9 +145,13 @@ func main() {
 
 	// Add generic routes
 	router.GET("/", servePong)
-	router.GET("/healthz", servePong)
+	router.GET("/healthz", serveHealthz)
+	router.GET("/livez", serveLivez)
+	router.GET("/readyz", serveReadyz)
 	router.GET("/ping", servePong)
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 	router.POST("/oauth/:provider", serveOauth, handleError("/oauth"))
+	startAdmin(router)
 
 	// Add app-specific routes
 	c := cron.New()
@@ -114,6 +163,9 @@ func main() {
 		startFaucet(router, c)
 		startVerifier(router, c)
 	}
+	startAlerts(c)
+	startMetrics(c)
+	startRefill(c)
 
 	// Start cron jobs
 	c.Start()
@@ -122,7 +174,7 @@ func main() {
 	}()
 
 	// Start Gin server
-	router.Run(":" + env.Port)
+	return router.Run(":" + env.Port)
 }
 
 var (
@@ -136,6 +188,8 @@ var (
 	ErrAddressBlocked       = errors.New("This address or Miner ID has reached its maximum usage of the faucet.")
 	ErrCounterReached       = errors.New("This notary has run out of data cap for today! Come back tomorrow.")
 	ErrMaxAllowanceFailed   = errors.New("Failed to calculate the maximum allowance for the user account and filecoin address")
+	ErrFaucetBudgetReached  = errors.New("The faucet has run out of FIL for today! Come back tomorrow.")
+	ErrModePaused           = errors.New("This service is paused for maintenance. Please try again later.")
 )
 
 type UserLock string
@@ -189,21 +243,21 @@ func serveOauth(c *gin.Context) {
 	}
 
 	// Exchange the `code` for an `access_token`
-	token, err := OAuthExchangeCodeForToken(provider, body.Code, body.State)
+	token, err := OAuthExchangeCodeForToken(c.Request.Context(), provider, body.Code, body.State)
 	if err != nil {
 		setError(c, http.StatusInternalServerError, errors.Wrap(err, "exchanging code for token"))
 		return
 	}
 
 	// Fetch the user's profile
-	accountData, err := provider.FetchAccountData(token)
+	accountData, err := provider.FetchAccountData(c.Request.Context(), token)
 	if err != nil {
 		setError(c, http.StatusInternalServerError, errors.Wrap(err, "fetching account data"))
 		return
 	}
 
 	// Update user record in Dynamo
-	user, err := getUserWithProviderUniqueID(providerName, accountData.UniqueID)
+	user, err := getUserWithProviderUniqueID(c.Request.Context(), providerName, accountData.UniqueID)
 	if err != nil {
 		setError(c, http.StatusInternalServerError, errors.Wrap(err, "fetching DynamoDB user"))
 		return
@@ -211,7 +265,7 @@ func serveOauth(c *gin.Context) {
 
 	user.Accounts[providerName] = accountData
 
-	err = saveUser(user)
+	err = saveUser(c.Request.Context(), user)
 	if err != nil {
 		setError(c, http.StatusInternalServerError, errors.Wrap(err, "saving DynamoDB user"))
 		return
@@ -237,32 +291,45 @@ func serveOauth(c *gin.Context) {
 }
 
 func serveVerifyAccount(c *gin.Context) {
+	decision := newGrantDecision(c, VerifierMode)
+
 	userID, err := getUserIDFromJWT(c)
 	if err != nil {
+		decision.reject("invalid_jwt")
 		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
 		return
 	}
 
-	user, err := getUserByID(userID)
+	user, err := getUserByID(c.Request.Context(), userID)
 	if err != nil {
+		decision.reject("stale_jwt")
 		c.JSON(http.StatusForbidden, gin.H{"error": ErrStaleJWT.Error()})
 		return
 	}
 
 	if len(user.Accounts) == 0 {
+		decision.reject("stale_jwt")
 		c.JSON(http.StatusForbidden, gin.H{"error": ErrStaleJWT.Error()})
 		return
 	}
+	decision.setUser(user)
 
 	if user.Locked_Verifier {
+		decision.reject("user_locked")
 		c.JSON(http.StatusForbidden, gin.H{"error": ErrUserLocked.Error()})
 		return
 	}
 
+	if isModePaused(VerifierMode) {
+		decision.reject("paused")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": ErrModePaused.Error()})
+		return
+	}
+
 	targetAddrStr := c.Param("target_addr")
 
 	// Ensure that the user hasn't used this address before
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	ctx, cancel := context.WithTimeout(detachedContext(c), 2*time.Minute)
 	defer cancel()
 
 	// Ensure that the user's account is old enough
@@ -272,6 +339,7 @@ func serveVerifyAccount(c *gin.Context) {
 		accountName := user.Accounts["github"].Username
 		accountAge := user.Accounts["github"].CreatedAt.String()
 		logger.Errorf("ACCOUNT TOO NEW: User ID %q, FIL Address %q, Account name %q, Account age %q", user.ID, targetAddrStr, accountName, accountAge)
+		decision.reject("account_too_new")
 		c.JSON(http.StatusForbidden, gin.H{"error": ErrUserTooNew.Error()})
 		return
 	}
@@ -281,89 +349,126 @@ func serveVerifyAccount(c *gin.Context) {
 		accountName := user.Accounts["github"].Username
 		lastAllocation := user.MostRecentAllocation.String()
 		logger.Errorf("REALLOCATION TOO SOON: User ID %q, FIL Address %q, Account name %q, Last allocation %q", user.ID, targetAddrStr, accountName, lastAllocation)
+		decision.reject("allocated_too_recently")
 		c.JSON(http.StatusForbidden, gin.H{"error": ErrAllocatedTooRecently.Error()})
 		return
 	}
 
-	// failsafe in case we're getting attacked so no one can drain the account of datacap
-	reachedCount, err := reachedCounter(c)
-	if reachedCount {
-		logger.Errorf("VERIFIER COUNTER REACHED: %v", env.MaxTotalAllocations)
-		c.JSON(http.StatusLocked, gin.H{"error": ErrCounterReached.Error()})
-		return
-	}
-
-	if err != nil {
-		logger.Errorf("VERIFIER COUNTER CALCULATION FAILED: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": ErrCounterReached.Error()})
-		return
-	}
+	allowance := env.MaxAllowanceBytes
 
-	dataCap, err := lotusCheckVerifierRemainingBytes(c, VerifierAddr.String())
+	dataCap, err := verifierSenders.total(ctx)
 	if err != nil {
 		logger.Errorf("LOTUS CHECK VERIFIER BYTES FAILED: %v", err)
+		decision.reject("datacap_check_failed")
 		c.JSON(http.StatusLocked, gin.H{"error": ErrCounterReached.Error()})
 		return
 	}
 
-	fiftyDataCaps := big.Mul(env.MaxAllowanceBytes, big.NewInt(50))
-	if dataCap.LessThanEqual(fiftyDataCaps) {
+	if dataCap.LessThanEqual(verifierLowDataCap()) {
 		logger.Warningf("LOW DATA CAP: %v", dataCap.String())
 	}
 
+	// Keep a floor of datacap the notary never hands out
+	if big.Sub(dataCap, allowance).LessThan(env.VerifierReserveBytes) {
+		logger.Errorf("VERIFIER DATA CAP RESERVE REACHED: %v remaining, %v reserved", dataCap.String(), env.VerifierReserveBytes.String())
+		decision.reject("datacap_reserve")
+		c.JSON(http.StatusLocked, gin.H{"error": ErrCounterReached.Error()})
+		return
+	}
+
 	targetAddr, err := address.NewFromString(targetAddrStr)
 	if err != nil {
+		decision.reject("invalid_address")
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	if isAddressBlocked(targetAddr) {
+		decision.reject("address_blocked")
 		c.JSON(http.StatusForbidden, gin.H{"error": ErrAddressBlocked.Error()})
 		return
 	}
 
-	// Lock the user for the duration of this operation until cron job cleans it up
-	err = lockUser(userID, UserLock_Verifier)
+	// failsafe in case we're getting attacked so no one can drain the account of datacap
+	// the budgets are held from here on and given back if the message never makes it to the mempool
+	reservations, err := reserveBudgets(ctx,
+		budgetAmount{allocationsBudget, 1},
+		budgetAmount{datacapBudget, allowance.Int64()},
+	)
+	if errors.Cause(err) == errBudgetReached {
+		logger.Errorf("VERIFIER BUDGET REACHED: %v", err)
+		decision.reject("budget_reached")
+		c.JSON(http.StatusLocked, gin.H{"error": ErrCounterReached.Error()})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusForbidden, gin.H{"error": ErrUserLocked.Error()})
+		logger.Errorf("REDIS RESERVE BUDGET FAILED: %v", err)
+		decision.reject("budget_error")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": ErrCounterReached.Error()})
 		return
 	}
+	releaseReservation := func() {
+		if err := releaseBudgets(ctx, reservations); err != nil {
+			logger.Errorf("REDIS RELEASE BUDGET FAILED: %v", err)
+		}
+	}
 
-	user, err = getUserByID(userID)
+	// Lock the user for the duration of this operation until cron job cleans it up
+	err = lockUser(ctx, userID, UserLock_Verifier)
 	if err != nil {
-		c.JSON(http.StatusForbidden, gin.H{"error": ErrStaleJWT.Error()})
+		releaseReservation()
+		decision.reject("user_locked")
+		c.JSON(http.StatusForbidden, gin.H{"error": ErrUserLocked.Error()})
 		return
 	}
 
-	allowance := env.MaxAllowanceBytes
-
-	// Allocate the bytes
-	err = incrementCounter(c)
+	user, err = getUserByID(ctx, userID)
 	if err != nil {
-		logger.Errorf("REDIS INCREMENT COUNT FAILED: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		releaseReservation()
+		decision.reject("stale_jwt")
+		c.JSON(http.StatusForbidden, gin.H{"error": ErrStaleJWT.Error()})
 		return
 	}
 
-	ctx, cancel = context.WithTimeout(context.Background(), 60*time.Minute)
+	ctx, cancel = context.WithTimeout(detachedContext(c), 60*time.Minute)
 	defer cancel()
 
-	cid, err := lotusVerifyAccount(ctx, targetAddrStr, allowance)
+	_, cid, err := verifierSenders.send(ctx, allowance, func(from address.Address) (cid.Cid, error) {
+		return lotusVerifyAccount(ctx, from, targetAddrStr, allowance)
+	})
+	if err == ErrNoSenderAvailable {
+		releaseReservation()
+		logger.Errorf("NO VERIFIER SENDER AVAILABLE: %v", err)
+		decision.reject("no_sender")
+		c.JSON(http.StatusLocked, gin.H{"error": ErrCounterReached.Error()})
+		return
+	}
 	if err != nil {
+		releaseReservation()
 		logger.Errorf("LOTUS VERIFY ACCOUNT FAILED: %v", err)
+		decision.reject("push_failed")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	err = saveGrant(ctx, newGrant(VerifierMode, user.ID, targetAddrStr, allowance.String(), cid.String()))
+	if err != nil {
+		logger.Errorf("ERROR SAVING GRANT: %v", err)
+	}
+
 	user.MostRecentDataCapCid = cid.String()
 	user.MostRecentVerifiedAddress = targetAddrStr
+	user.MostRecentMsigTxnID = ""
+	user.MostRecentMsigApproveCid = ""
 
-	err = saveUser(user)
+	err = saveUser(ctx, user)
 	if err != nil {
 		// TODO what to do here?
 		logger.Errorf("ERROR SAVING USER: %v", err)
 	}
 
+	decision.grant(allowance.String(), cid.String())
+
 	// Respond to the HTTP request
 	type Response struct {
 		Cid       string `json:"cid"`
@@ -376,27 +481,11 @@ func serveVerifyAccount(c *gin.Context) {
 }
 
 func serveListVerifiers(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	verifiers, err := lotusListVerifiers(ctx)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-	c.JSON(http.StatusOK, verifiers)
+	serveRegistry(c, func(s *registrySnapshot) []addrAndDataCap { return s.verifiers })
 }
 
 func serveListVerifiedClients(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	verifiedClients, err := lotusListVerifiedClients(ctx)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-	c.JSON(http.StatusOK, verifiedClients)
+	serveRegistry(c, func(s *registrySnapshot) []addrAndDataCap { return s.clients })
 }
 
 func serveAllowance(c *gin.Context) {
@@ -410,7 +499,7 @@ func serveAllowance(c *gin.Context) {
 func serveCheckAccountRemainingBytes(c *gin.Context) {
 	targetAddr := c.Param("target_addr")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(detachedContext(c), 30*time.Second)
 	defer cancel()
 
 	dcap, err := lotusCheckAccountRemainingBytes(ctx, targetAddr)
@@ -428,7 +517,7 @@ func serveCheckAccountRemainingBytes(c *gin.Context) {
 func serveCheckVerifierRemainingBytes(c *gin.Context) {
 	targetAddr := c.Param("target_addr")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(detachedContext(c), 30*time.Second)
 	defer cancel()
 
 	dcap, err := lotusCheckVerifierRemainingBytes(ctx, targetAddr)
@@ -440,30 +529,44 @@ func serveCheckVerifierRemainingBytes(c *gin.Context) {
 }
 
 func serveFaucet(c *gin.Context) {
+	decision := newGrantDecision(c, FaucetMode)
+
 	userID, err := getUserIDFromJWT(c)
 	if err != nil {
+		decision.reject("invalid_jwt")
 		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
 		return
 	}
 
-	user, err := getUserByID(userID)
+	user, err := getUserByID(c.Request.Context(), userID)
 	if err != nil {
+		decision.reject("stale_jwt")
 		c.JSON(http.StatusForbidden, gin.H{"error": ErrStaleJWT.Error()})
 		return
 	}
 
 	if len(user.Accounts) == 0 {
+		decision.reject("stale_jwt")
 		c.JSON(http.StatusForbidden, gin.H{"error": ErrStaleJWT.Error()})
 		return
 	}
+	decision.setUser(user)
 
 	if user.Locked_Faucet {
+		decision.reject("user_locked")
 		c.JSON(http.StatusForbidden, gin.H{"error": ErrUserLocked.Error()})
 		return
 	}
 
+	if isModePaused(FaucetMode) {
+		decision.reject("paused")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": ErrModePaused.Error()})
+		return
+	}
+
 	// This can get deleted, along with the `ReceivedFaucetGrant` key in dynamo if the faucet policy changes away from 1 time use only
 	if user.ReceivedFaucetGrant {
+		decision.reject("repeat_attempt")
 		c.JSON(http.StatusForbidden, gin.H{"error": ErrFaucetRepeatAttempt.Error()})
 		return
 	}
@@ -476,68 +579,166 @@ func serveFaucet(c *gin.Context) {
 		accountName := user.Accounts["github"].Username
 		accountAge := user.Accounts["github"].CreatedAt.String()
 		logger.Errorf("ACCOUNT TOO NEW: User ID %q, FIL Address %q, Account name %q, Account age %q", user.ID, targetAddrStr, accountName, accountAge)
+		decision.reject("account_too_new")
 		c.JSON(http.StatusForbidden, gin.H{"error": ErrUserTooNew.Error()})
 		return
 	}
 
+	ctx, cancel := context.WithTimeout(detachedContext(c), 2*time.Minute)
+	defer cancel()
+
+	targetAddr, err := address.NewFromString(targetAddrStr)
+	if err != nil {
+		decision.reject("invalid_address")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// A Miner ID is funded through its owner or worker, once the user shows they control one of them
+	var mg *minerGrant
+	recipient := targetAddr
+	if targetAddr.Protocol() == address.ID {
+		keys, err := lotusMinerKeys(ctx, targetAddr)
+		if err != nil && err != errNotMiner {
+			decision.reject("lotus_unavailable")
+			setError(c, http.StatusInternalServerError, errors.Wrapf(err, "getting miner info of %v", targetAddr))
+			return
+		}
+		if err == nil {
+			var reason string
+			var code int
+			mg, reason, code, err = verifyMinerGrant(c, userID, targetAddr, keys)
+			if err != nil {
+				decision.reject(reason)
+				c.JSON(code, gin.H{"error": err.Error()})
+				return
+			}
+			recipient = mg.recipient
+		}
+	}
+
+	if isAddressBlocked(targetAddr) || (recipient != targetAddr && isAddressBlocked(recipient)) {
+		decision.reject("address_blocked")
+		c.JSON(http.StatusForbidden, gin.H{"error": ErrAddressBlocked.Error()})
+		return
+	}
+
 	// Lock the user for the duration of this operation
-	err = lockUser(userID, UserLock_Faucet)
+	err = lockUser(ctx, userID, UserLock_Faucet)
 	if err != nil {
+		decision.reject("user_locked")
 		c.JSON(http.StatusForbidden, gin.H{"error": ErrUserLocked.Error()})
 		return
 	}
 
-	user, err = getUserByID(userID)
+	user, err = getUserByID(ctx, userID)
 	if err != nil {
+		decision.reject("stale_jwt")
 		c.JSON(http.StatusForbidden, gin.H{"error": ErrStaleJWT.Error()})
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-	defer cancel()
+	// the miner's slot is taken before anything is sent, so concurrent requests for one miner can't both pass
+	var minerSlot string
+	if mg != nil {
+		minerSlot, err = reserveMinerSlot(ctx, mg.miner.String(), env.FaucetMinerMaxGrants, env.FaucetMinerLimitWindow)
+		if err == errMinerSlotsTaken {
+			decision.reject("miner_limit_reached")
+			c.JSON(http.StatusForbidden, gin.H{"error": ErrMinerLimitReached.Error()})
+			return
+		}
+		if err != nil {
+			decision.reject("miner_limit_error")
+			setError(c, http.StatusInternalServerError, errors.Wrap(err, "reserving miner grant"))
+			return
+		}
+	}
+	releaseMiner := func() {
+		if minerSlot == "" {
+			return
+		}
+		if err := releaseMinerSlot(ctx, mg.miner.String(), minerSlot); err != nil {
+			logger.Errorf("ERROR RELEASING MINER GRANT: %v", err)
+		}
+	}
 
-	targetAddr, err := address.NewFromString(targetAddrStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	reservation, err := faucetBudget.reserve(ctx, filToNanoFIL(env.FaucetGrantSize).Int64())
+	if err == errBudgetReached {
+		releaseMiner()
+		decision.reject("budget_reached")
+		setError(c, http.StatusLocked, ErrFaucetBudgetReached)
 		return
 	}
-
-	if isAddressBlocked(targetAddr) {
-		c.JSON(http.StatusForbidden, gin.H{"error": ErrAddressBlocked.Error()})
+	if err != nil {
+		releaseMiner()
+		decision.reject("budget_error")
+		setError(c, http.StatusInternalServerError, errors.Wrap(err, "reserving faucet budget"))
 		return
 	}
+	releaseReservation := func() {
+		if err := reservation.release(ctx); err != nil {
+			logger.Errorf("REDIS RELEASE BUDGET FAILED: %v", err)
+		}
+		releaseMiner()
+	}
 
-	api, closer, err := lotusGetFullNodeAPI(ctx)
+	api, closer, err := lotusGetMpoolAPI(ctx)
 	if err != nil {
+		releaseReservation()
+		decision.reject("lotus_unavailable")
 		setError(c, http.StatusInternalServerError, errors.Wrap(err, "getting full node API"))
 		return
 	}
 	defer closer()
 
-	cid, err := lotusSendFIL(context.TODO(), api, FaucetAddr, targetAddr, env.FaucetGrantSize)
+	_, cid, err := faucetSenders.send(ctx, big.Int(env.FaucetGrantSize), func(from address.Address) (cid.Cid, error) {
+		return lotusSendFIL(ctx, api, from, recipient, env.FaucetGrantSize)
+	})
+	if err == ErrNoSenderAvailable {
+		releaseReservation()
+		decision.reject("no_sender")
+		setError(c, http.StatusLocked, ErrFaucetBudgetReached)
+		return
+	}
 	if err != nil {
-		setError(c, http.StatusInternalServerError, errors.Wrapf(err, "sending %v from %v to %v", env.FaucetGrantSize, FaucetAddr, targetAddr))
+		releaseReservation()
+		decision.reject("push_failed")
+		setError(c, http.StatusInternalServerError, errors.Wrapf(err, "sending %v to %v", env.FaucetGrantSize, recipient))
 		return
 	}
 
+	grant := newGrant(FaucetMode, user.ID, recipient.String(), env.FaucetGrantSize.String(), cid.String())
+	if mg != nil {
+		grant.Miner = mg.miner.String()
+	}
+	err = saveGrant(ctx, grant)
+	if err != nil {
+		logger.Errorf("ERROR SAVING GRANT: %v", err)
+	}
+
 	user.MostRecentFaucetGrantCid = cid.String()
-	user.MostRecentFaucetAddress = targetAddrStr
+	// the address the FIL went to, so a re-drive pays the owner or worker and not the miner actor
+	user.MostRecentFaucetAddress = recipient.String()
 
-	err = saveUser(user)
+	err = saveUser(ctx, user)
 	if err != nil {
 		logger.Errorf("ERR FOR NEW RELIC: %v", err)
 	}
 
+	decision.grant(env.FaucetGrantSize.String(), cid.String())
+
 	// Respond to the HTTP request
 	type Response struct {
 		Cid     string `json:"cid"`
 		Sent    string `json:"sent"`
 		Address string `json:"toAddress"`
+		Miner   string `json:"miner,omitempty"`
 	}
 	c.JSON(http.StatusOK, Response{
 		Cid:     cid.String(),
 		Sent:    env.FaucetGrantSize.String(),
-		Address: targetAddr.String(),
+		Address: recipient.String(),
+		Miner:   grant.Miner,
 	})
 }
 
@@ -570,33 +771,3 @@ func getUserIDFromJWT(c *gin.Context) (string, error) {
 	}
 	return userID, nil
 }
-
-func serveResetCounter(c *gin.Context) {
-	password := c.Param("pwd")
-	if password != env.AllocationsCounterResetPword {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed"})
-		return
-	}
-	if _, err := resetCounter(c); err != nil {
-		logger.Errorf("REDIS RESET COUNT FAILED: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	c.JSON(http.StatusAccepted, "")
-}
-
-func serveCurrentCount(c *gin.Context) {
-	password := c.Param("pwd")
-	if password != env.AllocationsCounterResetPword {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed"})
-		return
-	}
-	count, err := getCount(c)
-	if err != nil {
-		logger.Errorf("REDIS GET COUNT FAILED: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	c.JSON(http.StatusAccepted, count)
-}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// the environment is parsed by an init func, package variables are set up before it runs
+var _ = func() bool {
+	for k, v := range map[string]string{
+		"JWT_SECRET":                    "test-secret",
+		"AWS_ACCESS_KEY":                "test",
+		"AWS_SECRET_KEY":                "test",
+		"DYNAMODB_TABLE_NAME":           "verifier-test",
+		"GITHUB_CLIENT_ID":              "test",
+		"GITHUB_CLIENT_SECRET":          "test",
+		"LOTUS_API_DIAL_ADDR":           "test",
+		"CONFIRMATION_DEPTH":            "2",
+		"MAX_ALLOWANCE_BYTES":           "1099511627776",
+		"VERIFIER_MIN_ACCOUNT_AGE_DAYS": "0",
+		"FAUCET_MIN_ACCOUNT_AGE":        "0",
+		"REDIS_ENDPOINT":                "",
+	} {
+		os.Setenv(k, v)
+	}
+	return true
+}()
+
+const testUserID = "test-user"
+
+// testServer runs the grant handlers against a fake node, the mock signer and an in-memory table
+type testServer struct {
+	t      *testing.T
+	node   *fakeNode
+	signer *mockSigner
+	router *gin.Engine
+	jwt    string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	gin.SetMode(gin.TestMode)
+
+	node := newFakeNode()
+	lotusDialer = func(ctx context.Context, addr, token string) (lotusAPI, jsonrpc.ClientCloser, error) {
+		return node, func() {}, nil
+	}
+	lotusClient = &lotusPool{suspect: make(chan struct{}, 1)}
+	dynamoClient = newFakeDynamo()
+	t.Cleanup(func() {
+		lotusDialer = dialLotus
+		lotusClient = &lotusPool{suspect: make(chan struct{}, 1)}
+		dynamoClient = nil
+	})
+
+	signer := useMockSigner(t)
+	ctx := context.Background()
+	err := saveUser(ctx, User{
+		ID: testUserID,
+		Accounts: map[string]AccountData{
+			"github": {UniqueID: "1", Username: "octocat", CreatedAt: time.Now().AddDate(-1, 0, 0)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("saving user: %v", err)
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"userID": testUserID}).
+		SignedString([]byte(env.JWTSecret))
+	if err != nil {
+		t.Fatalf("signing JWT: %v", err)
+	}
+
+	router := gin.New()
+	router.POST("/verify/:target_addr", serveVerifyAccount)
+	router.POST("/faucet/:target_addr", serveFaucet, handleError("/faucet"))
+	return &testServer{t: t, node: node, signer: signer, router: router, jwt: token}
+}
+
+// post sends a grant request for target and decodes the response into out
+func (s *testServer) post(path string, target address.Address, out interface{}) int {
+	req := httptest.NewRequest(http.MethodPost, path+"/"+target.String(), nil)
+	req.Header.Set("Authorization", "Bearer "+s.jwt)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+		s.t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	return w.Code
+}
+
+// mine adds n blocks
+func (s *testServer) mine(n int) {
+	for i := 0; i < n; i++ {
+		s.node.mine()
+	}
+}
+
+func (s *testServer) user() User {
+	user, err := getUserByID(context.Background(), testUserID)
+	if err != nil {
+		s.t.Fatalf("getting user: %v", err)
+	}
+	return user
+}
+
+func (s *testServer) grantStatus(msgCid string) GrantStatus {
+	grant, err := getGrant(context.Background(), msgCid)
+	if err != nil {
+		s.t.Fatalf("getting grant %v: %v", msgCid, err)
+	}
+	return grant.Status
+}
+
+func testClientAddr(t *testing.T, seed string) address.Address {
+	addr, err := address.NewSecp256k1Address([]byte(seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+type grantResponse struct {
+	Cid   string `json:"cid"`
+	Error string `json:"error"`
+}
+
+func TestVerifyGrant(t *testing.T) {
+	s := newTestServer(t)
+	client := testClientAddr(t, "client")
+
+	var resp grantResponse
+	if code := s.post("/verify", client, &resp); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", code, resp.Error)
+	}
+	if !s.user().Locked_Verifier {
+		t.Fatal("expected the user to be locked while the grant is pending")
+	}
+	if got := s.grantStatus(resp.Cid); got != GrantPending {
+		t.Fatalf("expected %v, got %v", GrantPending, got)
+	}
+
+	signed := s.signer.Signed()
+	if len(signed) != 1 || signed[0].Signer != verifierSenders.addrs()[0] {
+		t.Fatalf("expected one message signed by the verifier, got %v", signed)
+	}
+
+	s.mine(1)
+	reconcileVerifierMessages()
+	if got := s.grantStatus(resp.Cid); got != GrantIncluded {
+		t.Fatalf("expected %v, got %v", GrantIncluded, got)
+	}
+
+	s.mine(env.ConfirmationDepth)
+	reconcileVerifierMessages()
+	if got := s.grantStatus(resp.Cid); got != GrantConfirmed {
+		t.Fatalf("expected %v, got %v", GrantConfirmed, got)
+	}
+	user := s.user()
+	if user.Locked_Verifier || user.MostRecentAllocation.IsZero() {
+		t.Fatalf("expected the user to be unlocked with an allocation, got %+v", user)
+	}
+	if dcap := s.node.clients[client]; !dcap.Equals(env.MaxAllowanceBytes) {
+		t.Fatalf("expected the client to get %v, got %v", env.MaxAllowanceBytes, dcap)
+	}
+}
+
+func TestVerifyPushFailure(t *testing.T) {
+	s := newTestServer(t)
+	s.node.failPush(errors.New("mpool is full"))
+
+	var resp grantResponse
+	if code := s.post("/verify", testClientAddr(t, "client"), &resp); code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", code)
+	}
+	if resp.Error != "mpool is full" {
+		t.Fatalf("expected the push error, got %q", resp.Error)
+	}
+	if grants, err := getGrants(context.Background(), VerifierMode, ""); err != nil || len(grants) != 0 {
+		t.Fatalf("expected no grant record, got %v (%v)", grants, err)
+	}
+}
+
+func TestVerifyMessageFails(t *testing.T) {
+	s := newTestServer(t)
+	client := testClientAddr(t, "client")
+	s.node.failTo(client, exitcode.ErrForbidden)
+
+	var resp grantResponse
+	if code := s.post("/verify", client, &resp); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", code, resp.Error)
+	}
+
+	s.mine(env.ConfirmationDepth + 1)
+	reconcileVerifierMessages()
+	if got := s.grantStatus(resp.Cid); got != GrantFailed {
+		t.Fatalf("expected %v, got %v", GrantFailed, got)
+	}
+	// the user stays locked until an admin deals with the failed grant
+	if !s.user().Locked_Verifier {
+		t.Fatal("expected the user to stay locked")
+	}
+}
+
+func TestVerifyReorg(t *testing.T) {
+	s := newTestServer(t)
+
+	var resp grantResponse
+	if code := s.post("/verify", testClientAddr(t, "client"), &resp); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", code, resp.Error)
+	}
+
+	s.mine(1)
+	reconcileVerifierMessages()
+	if got := s.grantStatus(resp.Cid); got != GrantIncluded {
+		t.Fatalf("expected %v, got %v", GrantIncluded, got)
+	}
+
+	s.node.reorg(1)
+	reconcileVerifierMessages()
+	if got := s.grantStatus(resp.Cid); got != GrantPending {
+		t.Fatalf("expected the reorged grant to be %v, got %v", GrantPending, got)
+	}
+	if !s.user().Locked_Verifier {
+		t.Fatal("expected the user to stay locked")
+	}
+
+	// the message goes back into the next block
+	s.mine(env.ConfirmationDepth + 1)
+	reconcileVerifierMessages()
+	if got := s.grantStatus(resp.Cid); got != GrantConfirmed {
+		t.Fatalf("expected %v, got %v", GrantConfirmed, got)
+	}
+	if s.user().Locked_Verifier {
+		t.Fatal("expected the user to be unlocked")
+	}
+}
+
+func TestFaucetGrant(t *testing.T) {
+	s := newTestServer(t)
+	recipient := testClientAddr(t, "recipient")
+
+	var resp grantResponse
+	if code := s.post("/faucet", recipient, &resp); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", code, resp.Error)
+	}
+	if !s.user().Locked_Faucet {
+		t.Fatal("expected the user to be locked while the grant is pending")
+	}
+
+	signed := s.signer.Signed()
+	if len(signed) != 1 || signed[0].Signer != faucetSenders.addrs()[0] {
+		t.Fatalf("expected one message signed by the faucet, got %v", signed)
+	}
+
+	s.mine(env.ConfirmationDepth + 1)
+	reconcileFaucetMessages()
+	if got := s.grantStatus(resp.Cid); got != GrantConfirmed {
+		t.Fatalf("expected %v, got %v", GrantConfirmed, got)
+	}
+	user := s.user()
+	if user.Locked_Faucet || !user.ReceivedFaucetGrant {
+		t.Fatalf("expected the user to be unlocked with a grant, got %+v", user)
+	}
+	if bal := s.node.balances[recipient]; !bal.Equals(big.Int(env.FaucetGrantSize)) {
+		t.Fatalf("expected %v, got %v", types.FIL(env.FaucetGrantSize), types.FIL(bal))
+	}
+
+	// the faucet is one grant per account
+	if code := s.post("/faucet", testClientAddr(t, "other"), &resp); code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", code)
+	}
+}
+
+func TestFaucetPushFailure(t *testing.T) {
+	s := newTestServer(t)
+	s.node.failPush(errors.New("mpool is full"))
+
+	var resp grantResponse
+	if code := s.post("/faucet", testClientAddr(t, "recipient"), &resp); code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", code)
+	}
+	if resp.Error == "" {
+		t.Fatal("expected an error")
+	}
+	if grants, err := getGrants(context.Background(), FaucetMode, ""); err != nil || len(grants) != 0 {
+		t.Fatalf("expected no grant record, got %v (%v)", grants, err)
+	}
+}
+
+func TestFaucetMessageFails(t *testing.T) {
+	s := newTestServer(t)
+	recipient := testClientAddr(t, "recipient")
+	s.node.failTo(recipient, exitcode.SysErrForbidden)
+
+	var resp grantResponse
+	if code := s.post("/faucet", recipient, &resp); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", code, resp.Error)
+	}
+
+	s.mine(env.ConfirmationDepth + 1)
+	reconcileFaucetMessages()
+	if got := s.grantStatus(resp.Cid); got != GrantFailed {
+		t.Fatalf("expected %v, got %v", GrantFailed, got)
+	}
+	user := s.user()
+	if !user.Locked_Faucet || user.ReceivedFaucetGrant {
+		t.Fatalf("expected the user to stay locked without a grant, got %+v", user)
+	}
+}
+
+func TestFaucetReorg(t *testing.T) {
+	s := newTestServer(t)
+	recipient := testClientAddr(t, "recipient")
+
+	var resp grantResponse
+	if code := s.post("/faucet", recipient, &resp); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", code, resp.Error)
+	}
+
+	s.mine(1)
+	reconcileFaucetMessages()
+	if got := s.grantStatus(resp.Cid); got != GrantIncluded {
+		t.Fatalf("expected %v, got %v", GrantIncluded, got)
+	}
+
+	s.node.reorg(1)
+	reconcileFaucetMessages()
+	if got := s.grantStatus(resp.Cid); got != GrantPending {
+		t.Fatalf("expected the reorged grant to be %v, got %v", GrantPending, got)
+	}
+	if _, ok := s.node.balances[recipient]; ok {
+		t.Fatal("expected the reorg to revert the transfer")
+	}
+
+	s.mine(env.ConfirmationDepth + 1)
+	reconcileFaucetMessages()
+	if got := s.grantStatus(resp.Cid); got != GrantConfirmed {
+		t.Fatalf("expected %v, got %v", GrantConfirmed, got)
+	}
+	if !s.user().ReceivedFaucetGrant {
+		t.Fatal("expected the user to have received the grant")
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/glifio/go-logger"
+	"github.com/pkg/errors"
+)
+
+// SignerBackend picks where the faucet and verifier keys live
+type SignerBackend string
+
+const (
+	// LocalSigner imports FAUCET_PK and VERIFIER_PK into an in-memory wallet
+	LocalSigner SignerBackend = "LOCAL"
+	// LotusSigner signs with the wallet of the connected Lotus node
+	LotusSigner SignerBackend = "LOTUS"
+	// RPCSigner signs through a remote JSON-RPC wallet, e.g. `lotus-wallet run`
+	RPCSigner SignerBackend = "RPC"
+)
+
+// Signer is the part of a wallet the verifier needs, LocalWallet and the lotus-wallet RPC API both satisfy it
+type Signer interface {
+	WalletSign(ctx context.Context, addr address.Address, msg []byte, meta api.MsgMeta) (*crypto.Signature, error)
+	WalletHas(ctx context.Context, addr address.Address) (bool, error)
+}
+
+// lotusWalletSigner adapts the v0 node API, whose WalletSign doesn't take message metadata. It signs
+// through the shared Lotus connection so it survives reconnects.
+type lotusWalletSigner struct{}
+
+func (s *lotusWalletSigner) WalletSign(ctx context.Context, addr address.Address, msg []byte, meta api.MsgMeta) (*crypto.Signature, error) {
+	node, err := lotusClient.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return node.WalletSign(ctx, addr, msg)
+}
+
+func (s *lotusWalletSigner) WalletHas(ctx context.Context, addr address.Address) (bool, error) {
+	node, err := lotusClient.get(ctx)
+	if err != nil {
+		return false, err
+	}
+	return node.WalletHas(ctx, addr)
+}
+
+// rpcSigner is a JSON-RPC client for a remote wallet
+type rpcSigner struct {
+	Internal struct {
+		WalletSign func(ctx context.Context, addr address.Address, msg []byte, meta api.MsgMeta) (*crypto.Signature, error)
+		WalletHas  func(ctx context.Context, addr address.Address) (bool, error)
+	}
+}
+
+func (s *rpcSigner) WalletSign(ctx context.Context, addr address.Address, msg []byte, meta api.MsgMeta) (*crypto.Signature, error) {
+	return s.Internal.WalletSign(ctx, addr, msg, meta)
+}
+
+func (s *rpcSigner) WalletHas(ctx context.Context, addr address.Address) (bool, error) {
+	return s.Internal.WalletHas(ctx, addr)
+}
+
+// signerKeys are the addresses a signer holds keys for. They only become the senders once the signer
+// passed checkSigner, so a failed reload leaves the running senders alone.
+type signerKeys struct {
+	faucet   []address.Address
+	verifier []address.Address
+	treasury address.Address
+	approver address.Address
+}
+
+// addrs lists every key the signer must hold
+func (k signerKeys) addrs() []address.Address {
+	addrs := append(append([]address.Address(nil), k.faucet...), k.verifier...)
+	for _, addr := range []address.Address{k.treasury, k.approver} {
+		if addr != address.Undef {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// install makes the keys the senders of the running modes
+func (k signerKeys) install() {
+	if len(k.faucet) > 0 {
+		setSenders(FaucetMode, k.faucet)
+	}
+	if len(k.verifier) > 0 {
+		setSenders(VerifierMode, k.verifier)
+	}
+	TreasuryAddr = k.treasury
+	MsigApproverAddr = k.approver
+}
+
+// remoteSignerAddrs takes the faucet and verifier addresses from the environment, since a remote signer
+// holds the keys
+func remoteSignerAddrs() (signerKeys, error) {
+	var keys signerKeys
+	if env.Mode != VerifierMode {
+		addrs, err := parseAddrList(env.FaucetAddr)
+		if err != nil {
+			return keys, errors.Wrap(err, "parsing FAUCET_ADDR")
+		}
+		keys.faucet = addrs
+
+		if env.TreasuryAddr != "" {
+			if keys.treasury, err = address.NewFromString(env.TreasuryAddr); err != nil {
+				return keys, errors.Wrap(err, "parsing TREASURY_ADDR")
+			}
+		}
+	}
+	if env.Mode != FaucetMode {
+		addrs, err := parseAddrList(env.VerifierAddr)
+		if err != nil {
+			return keys, errors.Wrap(err, "parsing VERIFIER_ADDR")
+		}
+		keys.verifier = addrs
+
+		if msigEnabled() && env.VerifierMsigApproverAddr != "" {
+			if keys.approver, err = address.NewFromString(env.VerifierMsigApproverAddr); err != nil {
+				return keys, errors.Wrap(err, "parsing VERIFIER_MSIG_APPROVER_ADDR")
+			}
+		}
+	}
+	return keys, nil
+}
+
+func parseAddrList(v string) ([]address.Address, error) {
+	items := splitList(v)
+	if len(items) == 0 {
+		return nil, errors.New("no address configured")
+	}
+	addrs := make([]address.Address, 0, len(items))
+	for _, item := range items {
+		addr, err := address.NewFromString(item)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// instantiateSigner builds the configured signer backend, with the keys it holds for the faucet and verifier
+func instantiateSigner(ctx context.Context) (Signer, signerKeys, jsonrpc.ClientCloser, error) {
+	noop := func() {}
+
+	switch env.SignerBackend {
+	case LocalSigner, "":
+		w, keys, err := instantiateWallet(ctx)
+		return w, keys, noop, err
+
+	case LotusSigner:
+		keys, err := remoteSignerAddrs()
+		if err != nil {
+			return nil, keys, noop, err
+		}
+		if _, _, err := lotusGetFullNodeAPI(ctx); err != nil {
+			return nil, keys, noop, err
+		}
+		return &lotusWalletSigner{}, keys, noop, nil
+
+	case RPCSigner:
+		keys, err := remoteSignerAddrs()
+		if err != nil {
+			return nil, keys, noop, err
+		}
+		headers := http.Header{}
+		if env.SignerRPCToken != "" {
+			headers.Add("Authorization", "Bearer "+env.SignerRPCToken)
+		}
+		var s rpcSigner
+		closer, err := jsonrpc.NewMergeClient(ctx, env.SignerRPCAddr, env.SignerRPCNamespace, []interface{}{&s.Internal}, headers)
+		if err != nil {
+			return nil, keys, noop, err
+		}
+		return &s, keys, closer, nil
+	}
+	return nil, signerKeys{}, noop, errors.Errorf("unknown signer backend %q", env.SignerBackend)
+}
+
+// checkSigner makes sure the signer can sign for every one of keys
+func checkSigner(ctx context.Context, s Signer, keys signerKeys) error {
+	for _, addr := range keys.verifier {
+		if keys.approver == addr {
+			return errors.New("the multisig approver must be a different signer than the proposers")
+		}
+	}
+	for _, addr := range keys.addrs() {
+		has, err := s.WalletHas(ctx, addr)
+		if err != nil {
+			return errors.Wrapf(err, "checking signer for %v", addr)
+		}
+		if !has {
+			return errors.Errorf("signer does not have a key for %v", addr)
+		}
+	}
+	return nil
+}
+
+// signerStats are kept per signing address
+type signerStats struct {
+	Signed       uint64    `json:"signed"`
+	Errors       uint64    `json:"errors"`
+	LastSignedAt time.Time `json:"lastSignedAt"`
+	LastError    string    `json:"lastError,omitempty"`
+	AvgLatencyMs float64   `json:"avgLatencyMs"`
+}
+
+// signerService holds the signer for the lifetime of the process, it is reloaded on SIGHUP or
+// through /admin/signer/reload to pick up rotated keys
+type signerService struct {
+	lk       sync.RWMutex
+	signer   Signer
+	keys     signerKeys
+	closer   jsonrpc.ClientCloser
+	loadedAt time.Time
+
+	statsLk sync.Mutex
+	stats   map[address.Address]*signerStats
+}
+
+var signers = &signerService{stats: make(map[address.Address]*signerStats)}
+
+// load builds and checks a new signer, then swaps it in along with its senders. The old signer and senders
+// keep serving when this fails.
+func (s *signerService) load(ctx context.Context) error {
+	signer, keys, closer, err := instantiateSigner(ctx)
+	if err != nil {
+		closer()
+		return err
+	}
+	if err := checkSigner(ctx, signer, keys); err != nil {
+		closer()
+		return err
+	}
+	s.swap(signer, keys, closer)
+	return nil
+}
+
+// swap installs a checked signer and its senders, then closes the old signer
+func (s *signerService) swap(signer Signer, keys signerKeys, closer jsonrpc.ClientCloser) {
+	s.lk.Lock()
+	oldCloser := s.closer
+	s.signer, s.keys, s.closer, s.loadedAt = signer, keys, closer, time.Now()
+	keys.install()
+	s.lk.Unlock()
+
+	if oldCloser != nil {
+		oldCloser()
+	}
+}
+
+func (s *signerService) close() {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.closer != nil {
+		s.closer()
+	}
+	s.signer, s.closer = nil, nil
+}
+
+// check makes sure the loaded signer still answers for every sender
+func (s *signerService) check(ctx context.Context) error {
+	s.lk.RLock()
+	signer, keys := s.signer, s.keys
+	s.lk.RUnlock()
+	if signer == nil {
+		return errors.New("signer is not loaded")
+	}
+	return checkSigner(ctx, signer, keys)
+}
+
+func (s *signerService) sign(ctx context.Context, addr address.Address, msg []byte, meta api.MsgMeta) (*crypto.Signature, error) {
+	s.lk.RLock()
+	signer := s.signer
+	s.lk.RUnlock()
+	if signer == nil {
+		return nil, errors.New("signer is not loaded")
+	}
+
+	start := time.Now()
+	sig, err := signer.WalletSign(ctx, addr, msg, meta)
+	s.record(addr, time.Since(start), err)
+	return sig, err
+}
+
+func (s *signerService) record(addr address.Address, latency time.Duration, err error) {
+	s.statsLk.Lock()
+	defer s.statsLk.Unlock()
+
+	st, ok := s.stats[addr]
+	if !ok {
+		st = &signerStats{}
+		s.stats[addr] = st
+	}
+	if err != nil {
+		st.Errors++
+		st.LastError = err.Error()
+		return
+	}
+	st.Signed++
+	st.LastSignedAt = time.Now()
+	latencyMs := float64(latency) / float64(time.Millisecond)
+	st.AvgLatencyMs += (latencyMs - st.AvgLatencyMs) / float64(st.Signed)
+}
+
+// signerStatus is what /admin/signer reports
+type signerStatus struct {
+	Backend  SignerBackend          `json:"backend"`
+	Loaded   bool                   `json:"loaded"`
+	LoadedAt time.Time              `json:"loadedAt"`
+	Stats    map[string]signerStats `json:"stats"`
+}
+
+func (s *signerService) status() signerStatus {
+	s.lk.RLock()
+	st := signerStatus{Backend: env.SignerBackend, Loaded: s.signer != nil, LoadedAt: s.loadedAt}
+	s.lk.RUnlock()
+
+	s.statsLk.Lock()
+	defer s.statsLk.Unlock()
+	st.Stats = make(map[string]signerStats, len(s.stats))
+	for addr, stats := range s.stats {
+		st.Stats[addr.String()] = *stats
+	}
+	return st
+}
+
+// reloadSignerOnSIGHUP reloads the keys whenever the process gets SIGHUP
+func reloadSignerOnSIGHUP() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			if err := signers.load(ctx); err != nil {
+				logger.Errorf("SIGNER RELOAD FAILED: %v", err)
+			} else {
+				logger.Infof("Signer reloaded, faucet %v, verifier %v", faucetSenders.addrs(), verifierSenders.addrs())
+			}
+			cancel()
+		}
+	}()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/wallet"
+	"github.com/filecoin-project/lotus/lib/sigs"
+	_ "github.com/filecoin-project/lotus/lib/sigs/secp"
+)
+
+// mockSigner is a LocalWallet with throwaway keys that also remembers every message it signed
+type mockSigner struct {
+	*wallet.LocalWallet
+
+	lk     sync.Mutex
+	signed []mockSignedMessage
+}
+
+type mockSignedMessage struct {
+	Signer address.Address
+	Msg    []byte
+}
+
+func (s *mockSigner) WalletSign(ctx context.Context, addr address.Address, msg []byte, meta api.MsgMeta) (*crypto.Signature, error) {
+	s.lk.Lock()
+	s.signed = append(s.signed, mockSignedMessage{addr, msg})
+	s.lk.Unlock()
+	return s.LocalWallet.WalletSign(ctx, addr, msg, meta)
+}
+
+// Signed returns the messages signed so far
+func (s *mockSigner) Signed() []mockSignedMessage {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return append([]mockSignedMessage(nil), s.signed...)
+}
+
+func newMockSigner(ctx context.Context) (*mockSigner, signerKeys, error) {
+	w, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		return nil, signerKeys{}, err
+	}
+	faucetAddr, err := w.WalletNew(ctx, types.KTSecp256k1)
+	if err != nil {
+		return nil, signerKeys{}, err
+	}
+	verifierAddr, err := w.WalletNew(ctx, types.KTSecp256k1)
+	if err != nil {
+		return nil, signerKeys{}, err
+	}
+	keys := signerKeys{faucet: []address.Address{faucetAddr}, verifier: []address.Address{verifierAddr}}
+	if msigEnabled() {
+		if keys.approver, err = w.WalletNew(ctx, types.KTSecp256k1); err != nil {
+			return nil, signerKeys{}, err
+		}
+	}
+	return &mockSigner{LocalWallet: w}, keys, nil
+}
+
+// useMockSigner makes a new mock signer the running one, its keys become the senders
+func useMockSigner(t *testing.T) *mockSigner {
+	ctx := context.Background()
+	s, keys, err := newMockSigner(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSigner(ctx, s, keys); err != nil {
+		t.Fatalf("expected the mock signer to hold its keys: %v", err)
+	}
+	signers.swap(s, keys, func() {})
+	return s
+}
+
+func TestMockSignerRecordsSignatures(t *testing.T) {
+	ctx := context.Background()
+	s, keys, err := newMockSigner(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := keys.faucet[0]
+	msg := []byte("message")
+	sig, err := s.WalletSign(ctx, from, msg, api.MsgMeta{Type: api.MTUnknown})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sigs.Verify(sig, from, msg); err != nil {
+		t.Fatalf("expected a valid signature: %v", err)
+	}
+
+	signed := s.Signed()
+	if len(signed) != 1 || signed[0].Signer != from || string(signed[0].Msg) != "message" {
+		t.Fatalf("expected the message to be recorded, got %v", signed)
+	}
+}
+
+func TestSignerSwapInstallsKeys(t *testing.T) {
+	ctx := context.Background()
+	s := useMockSigner(t)
+	keys := signers.keys
+	if got := faucetSenders.addrs(); len(got) != 1 || got[0] != keys.faucet[0] {
+		t.Fatalf("expected the faucet senders to be %v, got %v", keys.faucet, got)
+	}
+	if got := verifierSenders.addrs(); len(got) != 1 || got[0] != keys.verifier[0] {
+		t.Fatalf("expected the verifier senders to be %v, got %v", keys.verifier, got)
+	}
+
+	// a reload that fails leaves the running signer and senders alone
+	backend := env.SignerBackend
+	env.SignerBackend = "UNKNOWN"
+	defer func() { env.SignerBackend = backend }()
+	if err := signers.load(ctx); err == nil {
+		t.Fatal("expected an unknown backend to fail")
+	}
+	if got := faucetSenders.addrs(); got[0] != keys.faucet[0] {
+		t.Fatalf("expected the faucet senders to stay %v, got %v", keys.faucet, got)
+	}
+	if _, err := walletSignMessage(ctx, keys.verifier[0], []byte("message"), api.MsgMeta{}); err != nil {
+		t.Fatalf("expected the old signer to keep signing: %v", err)
+	}
+	if len(s.Signed()) != 1 {
+		t.Fatalf("expected the message to go through the old signer, got %v", s.Signed())
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	awssession "github.com/aws/aws-sdk-go/aws/session"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/pkg/errors"
+)
+
+// TracesExporter picks where spans go
+type TracesExporter string
+
+const (
+	// NoTraces keeps the global no-op tracer
+	NoTraces TracesExporter = "none"
+	// OTLPTraces exports over OTLP/HTTP, configured by the standard OTEL_EXPORTER_OTLP_* variables
+	OTLPTraces TracesExporter = "otlp"
+)
+
+// tracer starts our own spans, it is a no-op until initTracing installs a provider
+var tracer = otel.Tracer("github.com/openworklabs/oauthserver")
+
+// tracedHTTPClient is used for the calls to GitHub
+var tracedHTTPClient = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+
+// initTracing installs the configured exporter and returns a func that flushes it
+func initTracing(ctx context.Context) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+
+	switch env.TracesExporter {
+	case NoTraces, "":
+		return noop, nil
+	case OTLPTraces:
+	default:
+		return noop, errors.Errorf("unknown traces exporter %q", env.TracesExporter)
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return noop, err
+	}
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceNameKey.String(env.TracesServiceName),
+		attribute.String("verifier.mode", string(env.Mode)),
+	)
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+// detachedContext carries the request's span without its cancellation, for work that must finish even if
+// the client goes away
+func detachedContext(c *gin.Context) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(c.Request.Context()))
+}
+
+// endSpan records err on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceAWSRequests wraps every DynamoDB call made through sess in a span
+func traceAWSRequests(sess *awssession.Session) {
+	// Validate runs once per request while Send runs again on every retry
+	sess.Handlers.Validate.PushFrontNamed(request.NamedHandler{
+		Name: "otel.start",
+		Fn: func(r *request.Request) {
+			ctx, _ := tracer.Start(r.Context(), r.ClientInfo.ServiceName+"."+r.Operation.Name,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(
+					attribute.String("db.system", "dynamodb"),
+					attribute.String("db.name", env.DynamodbTableName),
+					attribute.String("db.operation", r.Operation.Name),
+				),
+			)
+			r.SetContext(ctx)
+		},
+	})
+	sess.Handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "otel.end",
+		Fn: func(r *request.Request) {
+			endSpan(trace.SpanFromContext(r.Context()), r.Error)
+		},
+	})
+}
@@ -3,58 +3,131 @@ package main
 import (
 	"context"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
 
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-state-types/crypto"
 	"github.com/filecoin-project/lotus/api"
 	"github.com/filecoin-project/lotus/chain/types"
 	"github.com/filecoin-project/lotus/chain/wallet"
+	"github.com/pkg/errors"
 )
 
-var w wallet.LocalWallet
-// FaucetAddr export
+// FaucetAddr export, the first of the faucet senders
 var FaucetAddr address.Address
-// VerifierAddr export
+// VerifierAddr export, the first of the verifier senders
 var VerifierAddr address.Address
 
-func importFaucetKey(ctx context.Context, w *wallet.LocalWallet) error {
-	pk, err := base64.StdEncoding.DecodeString(env.FaucetPrivateKey)
-	if err != nil { return err }
+// parseKeyInfo accepts a key exported by `lotus wallet export` (hex encoded KeyInfo JSON, any key type),
+// or a raw base64 BLS private key as used before
+func parseKeyInfo(key string) (*types.KeyInfo, error) {
+	key = strings.TrimSpace(key)
+	if b, err := hex.DecodeString(key); err == nil {
+		var ki types.KeyInfo
+		if err := json.Unmarshal(b, &ki); err == nil {
+			return &ki, nil
+		}
+	}
+
+	pk, err := base64.StdEncoding.DecodeString(key)
+	if err != nil { return nil, errors.New("key is neither a hex encoded KeyInfo nor a base64 BLS private key") }
+	return &types.KeyInfo{Type: types.KTBLS, PrivateKey: pk}, nil
+}
 
-	FaucetAddr, err = w.WalletImport(ctx, &types.KeyInfo{Type: types.KTBLS, PrivateKey: pk})
-	if err != nil { return err }
+// checkExpectedAddr guards against deploying the wrong key when an expected address is configured
+func checkExpectedAddr(name string, got address.Address, expected string) error {
+	if expected == "" { return nil }
+	want, err := address.NewFromString(expected)
+	if err != nil { return errors.Wrapf(err, "parsing expected %v address", name) }
+	if got != want {
+		return errors.Errorf("%v key derives %v but %v was expected", name, got, want)
+	}
 	return nil
 }
 
-func importVerifierKey(ctx context.Context, w *wallet.LocalWallet) error {
-	pk, err := base64.StdEncoding.DecodeString(env.VerifierPrivateKey)
-	if err != nil { return err }
+// splitList splits a comma separated environment variable, dropping empty entries
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// importKeys imports a comma separated list of keys, expected is the matching list of expected addresses
+func importKeys(ctx context.Context, w *wallet.LocalWallet, name, keys, expected string) ([]address.Address, error) {
+	pks := splitList(keys)
+	if len(pks) == 0 { return nil, errors.Errorf("no %v key configured", name) }
+	expectedAddrs := splitList(expected)
+	if len(expectedAddrs) != 0 && len(expectedAddrs) != len(pks) {
+		return nil, errors.Errorf("%v keys and expected addresses don't match up", name)
+	}
 
-	VerifierAddr, err = w.WalletImport(ctx, &types.KeyInfo{Type: types.KTBLS, PrivateKey: pk})
-	if err != nil { return err }
-	return nil
+	addrs := make([]address.Address, 0, len(pks))
+	for i, pk := range pks {
+		ki, err := parseKeyInfo(pk)
+		if err != nil { return nil, errors.Wrapf(err, "parsing %v key %d", name, i) }
+
+		addr, err := w.WalletImport(ctx, ki)
+		if err != nil { return nil, err }
+		if len(expectedAddrs) != 0 {
+			if err := checkExpectedAddr(name, addr, expectedAddrs[i]); err != nil { return nil, err }
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+func importFaucetKey(ctx context.Context, w *wallet.LocalWallet) ([]address.Address, error) {
+	addrs, err := importKeys(ctx, w, "faucet", env.FaucetPrivateKey, env.FaucetExpectedAddr)
+	if err != nil { return nil, errors.Wrap(err, "importing FAUCET_PK") }
+	return addrs, nil
+}
+
+func importVerifierKey(ctx context.Context, w *wallet.LocalWallet) ([]address.Address, error) {
+	addrs, err := importKeys(ctx, w, "verifier", env.VerifierPrivateKey, env.VerifierExpectedAddr)
+	if err != nil { return nil, errors.Wrap(err, "importing VERIFIER_PK") }
+	return addrs, nil
+}
+
+// importTreasuryKey is optional, without it the faucet is never refilled automatically
+func importTreasuryKey(ctx context.Context, w *wallet.LocalWallet) (address.Address, error) {
+	if env.TreasuryPrivateKey == "" { return address.Undef, nil }
+
+	ki, err := parseKeyInfo(env.TreasuryPrivateKey)
+	if err != nil { return address.Undef, errors.Wrap(err, "parsing TREASURY_PK") }
+	return w.WalletImport(ctx, ki)
 }
 
-func instantiateWallet(ctx context.Context) (w *wallet.LocalWallet, err error) {
+// importApproverKey is optional, it's the second signer of the verifier multisig
+func importApproverKey(ctx context.Context, w *wallet.LocalWallet) (address.Address, error) {
+	if !msigEnabled() || env.VerifierMsigApproverPrivateKey == "" { return address.Undef, nil }
+
+	ki, err := parseKeyInfo(env.VerifierMsigApproverPrivateKey)
+	if err != nil { return address.Undef, errors.Wrap(err, "parsing VERIFIER_MSIG_APPROVER_PK") }
+	return w.WalletImport(ctx, ki)
+}
+
+// instantiateWallet imports the keys of the running modes, it leaves the senders to the caller
+func instantiateWallet(ctx context.Context) (w *wallet.LocalWallet, keys signerKeys, err error) {
 	keystore := wallet.NewMemKeyStore()
 	w, err = wallet.NewWallet(keystore)
-	if err != nil { return w, err }
-	if env.Mode == FaucetMode {
-		if err := importFaucetKey(ctx, w); err != nil { return w, err }
-		return w, nil
-	} else if env.Mode == VerifierMode {
-		if err := importVerifierKey(ctx, w); err != nil { return w, err }
-		return w, nil
+	if err != nil { return w, keys, err }
+	if env.Mode != VerifierMode {
+		if keys.treasury, err = importTreasuryKey(ctx, w); err != nil { return w, keys, err }
+		if keys.faucet, err = importFaucetKey(ctx, w); err != nil { return w, keys, err }
 	}
-
-	if err := importFaucetKey(ctx, w); err != nil { return w, err }
-	if err := importVerifierKey(ctx, w); err != nil { return w, err }
-
-	return w, nil
+	if env.Mode != FaucetMode {
+		if keys.verifier, err = importVerifierKey(ctx, w); err != nil { return w, keys, err }
+		if keys.approver, err = importApproverKey(ctx, w); err != nil { return w, keys, err }
+	}
+	return w, keys, nil
 }
 
 func walletSignMessage(ctx context.Context, signerAddr address.Address, message []byte, msgMeta api.MsgMeta) (*crypto.Signature, error) {
-	w, err := instantiateWallet(ctx)
-	if err != nil { return &crypto.Signature{}, err }
-	return w.WalletSign(ctx, signerAddr, message, msgMeta)
+	return signers.sign(ctx, signerAddr, message, msgMeta)
 }